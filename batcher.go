@@ -0,0 +1,284 @@
+package presence
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrInvalidBatch for stating the batch size or the flush interval is not
+// usable
+var ErrInvalidBatch = errors.New("batch size and flush interval should be positive")
+
+// Batcher coalesces the Online calls of many goroutines into bulk Online calls
+// of the session. Ids are buffered and deduplicated until the buffer reaches
+// the batch size or the flush interval passes. Ids that are flushed within
+// the refresh duration are not sent again, their keys are still alive
+type Batcher struct {
+	// session that the buffered ids are sent to
+	session *Session
+
+	// size is the max number of ids in a batch
+	size int
+
+	// interval is the max time that an id waits in the buffer
+	interval time.Duration
+
+	// refresh is the duration that an id is not sent again after it is
+	// flushed, zero disables skipping
+	refresh time.Duration
+
+	// pending ids in the order of their first call, and their set for
+	// deduplication
+	pending  []string
+	buffered map[string]struct{}
+
+	// refreshed holds the flush time of the recently flushed ids
+	refreshed map[string]time.Time
+
+	// errors of the background flushes
+	errChan chan error
+
+	// full is signaled when the buffer reaches the batch size
+	full chan struct{}
+
+	// done is closed when the batcher is closed, and stopped is closed when the
+	// flush loop returns
+	done    chan struct{}
+	stopped chan struct{}
+	closed  bool
+
+	// flushing serializes the flushes and the Offline calls, so an id that
+	// goes offline is never set as online by a flush that already took it
+	flushing sync.Mutex
+
+	mu sync.Mutex
+}
+
+// NewBatcher creates a Batcher in front of the given session. Batches are
+// flushed when they have size ids or when interval passes. Ids are not sent
+// again until refresh passes after their flush, it should be comfortably
+// shorter than the inactive duration of the backend, e.g. the half of it.
+// Zero refresh sends every flushed id
+func NewBatcher(session *Session, size int, interval, refresh time.Duration) (*Batcher, error) {
+	if size <= 0 || interval <= 0 {
+		return nil, ErrInvalidBatch
+	}
+
+	if refresh < 0 {
+		return nil, ErrInvalidDuration
+	}
+
+	b := &Batcher{
+		session:   session,
+		size:      size,
+		interval:  interval,
+		refresh:   refresh,
+		buffered:  make(map[string]struct{}),
+		refreshed: make(map[string]time.Time),
+		errChan:   make(chan error, 1),
+		full:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+
+	go b.run()
+
+	return b, nil
+}
+
+// Online buffers the given ids to be set as online with the next flush. Ids
+// that are already buffered or recently flushed are skipped
+func (b *Batcher) Online(ids ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+
+	now := time.Now()
+	for _, id := range ids {
+		if _, ok := b.buffered[id]; ok {
+			continue
+		}
+
+		if at, ok := b.refreshed[id]; ok && now.Sub(at) < b.refresh {
+			continue
+		}
+
+		b.buffered[id] = struct{}{}
+		b.pending = append(b.pending, id)
+	}
+
+	if len(b.pending) >= b.size {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Offline sets the given ids as offline right away. They are removed from the
+// buffer and they are not skipped by the next Online calls. A flush that is in
+// progress is waited for, so it can not set the ids as online afterwards
+func (b *Batcher) Offline(ids ...string) error {
+	return b.OfflineContext(context.Background(), ids...)
+}
+
+// OfflineContext is the context aware version of Offline
+func (b *Batcher) OfflineContext(ctx context.Context, ids ...string) error {
+	b.flushing.Lock()
+	defer b.flushing.Unlock()
+
+	b.mu.Lock()
+	for _, id := range ids {
+		delete(b.refreshed, id)
+
+		if _, ok := b.buffered[id]; !ok {
+			continue
+		}
+
+		delete(b.buffered, id)
+		for i, pending := range b.pending {
+			if pending == id {
+				b.pending = append(b.pending[:i], b.pending[i+1:]...)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	return b.session.OfflineContext(ctx, ids...)
+}
+
+// Flush sends the buffered ids to the session right away
+func (b *Batcher) Flush() error {
+	return b.FlushContext(context.Background())
+}
+
+// FlushContext is the context aware version of Flush
+func (b *Batcher) FlushContext(ctx context.Context) error {
+	b.flushing.Lock()
+	defer b.flushing.Unlock()
+
+	b.mu.Lock()
+	ids := b.pending
+	b.pending = nil
+	b.buffered = make(map[string]struct{})
+	b.mu.Unlock()
+
+	for len(ids) > 0 {
+		n := b.size
+		if n > len(ids) {
+			n = len(ids)
+		}
+
+		if err := b.session.OnlineContext(ctx, ids[:n]...); err != nil {
+			// put the unsent ids back to be sent with the next flush
+			b.requeue(ids)
+			return err
+		}
+
+		b.mu.Lock()
+		if b.refresh > 0 {
+			now := time.Now()
+			for _, id := range ids[:n] {
+				b.refreshed[id] = now
+			}
+		}
+		b.mu.Unlock()
+
+		ids = ids[n:]
+	}
+
+	return nil
+}
+
+// requeue adds the ids to the front of the buffer unless they are buffered
+// again in the meantime
+func (b *Batcher) requeue(ids []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pending := make([]string, 0, len(ids)+len(b.pending))
+	for _, id := range ids {
+		if _, ok := b.buffered[id]; ok {
+			continue
+		}
+
+		b.buffered[id] = struct{}{}
+		pending = append(pending, id)
+	}
+
+	b.pending = append(pending, b.pending...)
+}
+
+// Error returns the channel that the errors of the background flushes are
+// sent to, errors are dropped if the channel is not read
+func (b *Batcher) Error() chan error {
+	return b.errChan
+}
+
+// Close flushes the buffered ids and stops the batcher. The session is not
+// closed
+func (b *Batcher) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrClosed
+	}
+
+	b.closed = true
+	b.mu.Unlock()
+
+	close(b.done)
+	<-b.stopped
+
+	return b.Flush()
+}
+
+// run flushes the buffer when it is full or when the interval passes
+func (b *Batcher) run() {
+	defer close(b.stopped)
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.expire(time.Now())
+		case <-b.full:
+		case <-b.done:
+			return
+		}
+
+		if err := b.Flush(); err != nil {
+			b.reportError(err)
+		}
+	}
+}
+
+// expire removes the flush times that are not used for skipping anymore
+func (b *Batcher) expire(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for id, at := range b.refreshed {
+		if now.Sub(at) >= b.refresh {
+			delete(b.refreshed, id)
+		}
+	}
+}
+
+// reportError sends the error to the error channel without blocking
+func (b *Batcher) reportError(err error) {
+	select {
+	case b.errChan <- err:
+	default:
+	}
+}
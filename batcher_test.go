@@ -0,0 +1,314 @@
+package presence
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingBackend records the ids of the Online calls. If release is set,
+// Online calls signal entered and wait for release before they are run
+type countingBackend struct {
+	Backend
+
+	mu      sync.Mutex
+	calls   [][]string
+	err     error
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (c *countingBackend) OnlineContext(ctx context.Context, ids ...string) error {
+	c.mu.Lock()
+	entered, release := c.entered, c.release
+	c.mu.Unlock()
+
+	if release != nil {
+		entered <- struct{}{}
+		<-release
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+
+	c.calls = append(c.calls, append([]string(nil), ids...))
+	return c.Backend.OnlineContext(ctx, ids...)
+}
+
+func (c *countingBackend) Calls() [][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.calls
+}
+
+func withBatcher(size int, interval, refresh time.Duration, f func(b *Batcher, backend *countingBackend)) error {
+	memory, err := NewMemory(testMemoryTimeoutDuration)
+	if err != nil {
+		return err
+	}
+
+	backend := &countingBackend{Backend: memory}
+	s, err := New(backend)
+	if err != nil {
+		return err
+	}
+
+	b, err := NewBatcher(s, size, interval, refresh)
+	if err != nil {
+		return err
+	}
+
+	f(b, backend)
+
+	if err := b.Close(); err != nil && err != ErrClosed {
+		return err
+	}
+
+	return s.Close()
+}
+
+func TestBatcherInvalid(t *testing.T) {
+	if _, err := NewBatcher(nil, 0, time.Second, 0); err != ErrInvalidBatch {
+		t.Fatalf("err should be %s, but got: %v", ErrInvalidBatch, err)
+	}
+
+	if _, err := NewBatcher(nil, 1, time.Second, -time.Second); err != ErrInvalidDuration {
+		t.Fatalf("err should be %s, but got: %v", ErrInvalidDuration, err)
+	}
+}
+
+func TestBatcherSize(t *testing.T) {
+	err := withBatcher(2, time.Hour, 0, func(b *Batcher, backend *countingBackend) {
+		id1, id2 := <-nextID, <-nextID
+
+		// duplicates are sent once
+		if err := b.Online(id1, id1); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Online(id2); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond * 20)
+
+		calls := backend.Calls()
+		if len(calls) != 1 || len(calls[0]) != 2 || calls[0][0] != id1 || calls[0][1] != id2 {
+			t.Fatalf("there should be one call with [%s %s], but got: %v", id1, id2, calls)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatcherInterval(t *testing.T) {
+	err := withBatcher(100, time.Millisecond*20, 0, func(b *Batcher, backend *countingBackend) {
+		id := <-nextID
+		if err := b.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		if calls := backend.Calls(); len(calls) != 0 {
+			t.Fatalf("ids should be buffered, but got: %v", calls)
+		}
+
+		time.Sleep(time.Millisecond * 50)
+
+		calls := backend.Calls()
+		if len(calls) != 1 || calls[0][0] != id {
+			t.Fatalf("there should be one call with [%s], but got: %v", id, calls)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatcherRefresh(t *testing.T) {
+	err := withBatcher(100, time.Hour, time.Millisecond*50, func(b *Batcher, backend *countingBackend) {
+		id := <-nextID
+		for i := 0; i < 2; i++ {
+			if err := b.Online(id); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := b.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if calls := backend.Calls(); len(calls) != 1 {
+			t.Fatalf("recently flushed id should be skipped, but got: %v", calls)
+		}
+
+		// offline ids are not skipped
+		if err := b.Offline(id); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		if calls := backend.Calls(); len(calls) != 2 {
+			t.Fatalf("offline id should be sent again, but got: %v", calls)
+		}
+
+		time.Sleep(time.Millisecond * 50)
+
+		if err := b.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		if calls := backend.Calls(); len(calls) != 3 {
+			t.Fatalf("id should be sent again after the refresh duration, but got: %v", calls)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatcherOfflineWhileFlushing(t *testing.T) {
+	err := withBatcher(100, time.Hour, time.Hour, func(b *Batcher, backend *countingBackend) {
+		id := <-nextID
+		if err := b.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		backend.mu.Lock()
+		backend.entered = make(chan struct{})
+		backend.release = make(chan struct{})
+		entered, release := backend.entered, backend.release
+		backend.mu.Unlock()
+
+		flushed := make(chan error, 1)
+		go func() {
+			flushed <- b.Flush()
+		}()
+
+		// id is taken from the buffer and it is being sent
+		<-entered
+
+		offline := make(chan error, 1)
+		go func() {
+			offline <- b.Offline(id)
+		}()
+
+		time.Sleep(time.Millisecond * 20)
+
+		backend.mu.Lock()
+		backend.entered, backend.release = nil, nil
+		backend.mu.Unlock()
+		close(release)
+
+		if err := <-flushed; err != nil {
+			t.Fatal(err)
+		}
+
+		if err := <-offline; err != nil {
+			t.Fatal(err)
+		}
+
+		// offline call wins over the flush that was in progress
+		status, err := b.session.Status(id)
+		if err != nil || status[0].Status != Offline {
+			t.Fatalf("%s should be offline, but got: %v %v", id, status, err)
+		}
+
+		if err := b.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		if calls := backend.Calls(); len(calls) != 2 {
+			t.Fatalf("offline id should be sent again, but got: %v", calls)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatcherError(t *testing.T) {
+	err := withBatcher(100, time.Hour, 0, func(b *Batcher, backend *countingBackend) {
+		id := <-nextID
+		if err := b.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		backend.mu.Lock()
+		backend.err = errors.New("unavailable")
+		backend.mu.Unlock()
+
+		if err := b.Flush(); err == nil {
+			t.Fatal("flush should fail")
+		}
+
+		backend.mu.Lock()
+		backend.err = nil
+		backend.mu.Unlock()
+
+		// failed ids are sent with the next flush
+		if err := b.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		calls := backend.Calls()
+		if len(calls) != 1 || calls[0][0] != id {
+			t.Fatalf("there should be one call with [%s], but got: %v", id, calls)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatcherClose(t *testing.T) {
+	err := withBatcher(100, time.Hour, 0, func(b *Batcher, backend *countingBackend) {
+		id := <-nextID
+		if err := b.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if calls := backend.Calls(); len(calls) != 1 {
+			t.Fatalf("buffered ids should be flushed on close, but got: %v", calls)
+		}
+
+		if err := b.Online(id); err != ErrClosed {
+			t.Fatalf("err should be %s, but got: %v", ErrClosed, err)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -45,20 +45,19 @@ func main() {
 }
 
 func pingdom(session *presence.Session, start, end int) {
-	throttleCount := 1500
-	req := make([]string, throttleCount)
-	count := 0
-	for i := start; i <= end; i++ {
-		req[count] = strconv.Itoa(i)
-		if count == throttleCount-1 {
-			err := session.Online(req...)
-			if err != nil {
-				fmt.Println(err)
-			}
+	batcher, err := presence.NewBatcher(session, 1500, time.Millisecond*100, time.Millisecond*500)
+	if err != nil {
+		panic(err)
+	}
 
-			count = 0
+	for i := start; i <= end; i++ {
+		if err := batcher.Online(strconv.Itoa(i)); err != nil {
+			fmt.Println(err)
 		}
-		count++
+	}
+
+	if err := batcher.Close(); err != nil {
+		fmt.Println(err)
 	}
 }
 
@@ -18,8 +18,8 @@ func ExampleRedis_listenStatusChanges() {
 	}
 
 	// adjust config for redis instance
-	c := backend.(*Redis).redis.Pool().Get()
-	if _, err := c.Do("CONFIG", "SET", "notify-keyspace-events", "Ex$"); err != nil {
+	c := backend.(*Redis).pool.Get()
+	if _, err := c.Do("CONFIG", "SET", "notify-keyspace-events", "Ex"); err != nil {
 		fmt.Println(err)
 	}
 
@@ -34,11 +34,12 @@ func ExampleRedis_listenStatusChanges() {
 
 	go func() {
 		for event := range s.ListenStatusChanges() {
+			// time and sequence number differ in every run
 			switch event.Status {
 			case Online:
-				fmt.Println(event)
+				fmt.Println(event.ID, event.Status)
 			case Offline:
-				fmt.Println(event)
+				fmt.Println(event.ID, event.Status)
 			}
 		}
 	}()
@@ -51,6 +52,6 @@ func ExampleRedis_listenStatusChanges() {
 	<-time.After(time.Second * 2)
 
 	// Output:
-	// {id ONLINE}
-	// {id OFFLINE}
+	// id ONLINE
+	// id OFFLINE
 }
@@ -0,0 +1,404 @@
+package presence
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	gredis "github.com/garyburd/redigo/redis"
+)
+
+// Join adds the given ids to the group, groups are created with their first
+// members
+func (s *Session) Join(group string, ids ...string) error {
+	return s.backend.Join(group, ids...)
+}
+
+// JoinContext is the context aware version of Join
+func (s *Session) JoinContext(ctx context.Context, group string, ids ...string) error {
+	return s.backend.JoinContext(ctx, group, ids...)
+}
+
+// Leave removes the given ids from the group
+func (s *Session) Leave(group string, ids ...string) error {
+	return s.backend.Leave(group, ids...)
+}
+
+// LeaveContext is the context aware version of Leave
+func (s *Session) LeaveContext(ctx context.Context, group string, ids ...string) error {
+	return s.backend.LeaveContext(ctx, group, ids...)
+}
+
+// Members returns the ids in the group regardless of their statuses
+func (s *Session) Members(group string) ([]string, error) {
+	return s.backend.Members(group)
+}
+
+// MembersContext is the context aware version of Members
+func (s *Session) MembersContext(ctx context.Context, group string) ([]string, error) {
+	return s.backend.MembersContext(ctx, group)
+}
+
+// GroupStatus returns the current statuses of the members of the group, see
+// Status for the failed lookups
+func (s *Session) GroupStatus(group string) ([]Event, error) {
+	return s.GroupStatusContext(context.Background(), group)
+}
+
+// GroupStatusContext is the context aware version of GroupStatus
+func (s *Session) GroupStatusContext(ctx context.Context, group string) ([]Event, error) {
+	ids, err := s.backend.MembersContext(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	return s.backend.StatusContext(ctx, ids...)
+}
+
+// GroupOnlineCount returns the number of the members of the group that are not
+// offline and the number of all of its members. Invisible members are counted
+// as offline, as they are displayed to the others
+func (s *Session) GroupOnlineCount(group string) (online, total int, err error) {
+	return s.GroupOnlineCountContext(context.Background(), group)
+}
+
+// GroupOnlineCountContext is the context aware version of GroupOnlineCount
+func (s *Session) GroupOnlineCountContext(ctx context.Context, group string) (online, total int, err error) {
+	status, err := s.GroupStatusContext(ctx, group)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, st := range status {
+		if st.Status != Offline && st.Status != Invisible {
+			online++
+		}
+	}
+
+	return online, len(status), nil
+}
+
+// SubscribeGroup creates a subscription to the status changes of the members
+// of the group. Members that join or leave the group afterwards are followed
+// by the subscription
+func (s *Session) SubscribeGroup(group string, opts ...SubscribeOption) (*Subscription, error) {
+	return s.backend.SubscribeGroup(group, opts...)
+}
+
+// SubscribeGroupContext is the context aware version of SubscribeGroup, the
+// subscription is closed when the context is done
+func (s *Session) SubscribeGroupContext(ctx context.Context, group string, opts ...SubscribeOption) (*Subscription, error) {
+	return s.backend.SubscribeGroupContext(ctx, group, opts...)
+}
+
+// groupMembers is the local copy of the members of a group that the group
+// subscriptions of the Redis backend filter the events with. Membership
+// changes are published by Join and Leave, the ones that arrive while the
+// members are being loaded are applied after loading, so none of them is lost
+type groupMembers struct {
+	// refs is the number of the subscriptions of the group, it is guarded by
+	// the lock of the backend
+	refs int
+
+	// load serializes the loading of the members
+	load sync.Mutex
+
+	// ids are valid if loaded is true, changes are kept in pending until
+	// then. gen is incremented whenever the members should be loaded again
+	ids     map[string]struct{}
+	loaded  bool
+	pending []string
+	gen     int
+	mu      sync.Mutex
+}
+
+// has reports whether the id of the event is a member of the group
+func (g *groupMembers) has(e Event) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, ok := g.ids[e.ID]
+	return ok
+}
+
+// change applies a published membership change, "+id" for the joins and
+// "-id" for the leaves
+func (g *groupMembers) change(change string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.loaded {
+		g.pending = append(g.pending, change)
+		return
+	}
+
+	g.apply(change)
+}
+
+// apply applies the membership change, must be called with the lock held
+func (g *groupMembers) apply(change string) {
+	if len(change) < 2 {
+		return
+	}
+
+	switch change[0] {
+	case '+':
+		g.ids[change[1:]] = struct{}{}
+	case '-':
+		delete(g.ids, change[1:])
+	}
+}
+
+// state returns whether the members are loaded and the current generation
+func (g *groupMembers) state() (bool, int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.loaded, g.gen
+}
+
+// reset replaces the members with the loaded ones and applies the pending
+// changes on top of them. Returns false if the members are invalidated after
+// the given generation, they should be loaded again then
+func (g *groupMembers) reset(ids []string, gen int) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.gen != gen {
+		return false
+	}
+
+	g.ids = make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		g.ids[id] = struct{}{}
+	}
+
+	// pending changes may already be in the loaded ones, applying them again
+	// is harmless
+	for _, change := range g.pending {
+		g.apply(change)
+	}
+
+	g.pending = nil
+	g.loaded = true
+	return true
+}
+
+// invalidate marks the members to be loaded again, e.g. the changes may be
+// missed while the subscription is dropped
+func (g *groupMembers) invalidate() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.loaded = false
+	g.pending = nil
+	g.gen++
+}
+
+// Join adds the given ids to the set of the group and publishes the changes to
+// the group subscriptions in one transaction
+func (s *Redis) Join(group string, ids ...string) error {
+	return s.JoinContext(context.Background(), group, ids...)
+}
+
+// JoinContext is the context aware version of Join
+func (s *Redis) JoinContext(ctx context.Context, group string, ids ...string) error {
+	return s.changeMembers(ctx, group, "SADD", "+", ids)
+}
+
+// Leave removes the given ids from the set of the group and publishes the
+// changes to the group subscriptions in one transaction
+func (s *Redis) Leave(group string, ids ...string) error {
+	return s.LeaveContext(context.Background(), group, ids...)
+}
+
+// LeaveContext is the context aware version of Leave
+func (s *Redis) LeaveContext(ctx context.Context, group string, ids ...string) error {
+	return s.changeMembers(ctx, group, "SREM", "-", ids)
+}
+
+// changeMembers runs the given set command for the ids and publishes them
+// with the given operation to the channel of the group
+func (s *Redis) changeMembers(ctx context.Context, group, cmd, op string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// get one connection from pool
+	c, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	// close connection
+	defer c.Close()
+
+	key := s.groupKey(group)
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, key)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	// init multi command
+	c.Send("MULTI")
+	c.Send(cmd, args...)
+
+	// channel of the group has the same name with its set
+	for _, id := range ids {
+		c.Send("PUBLISH", key, op+id)
+	}
+
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// Members returns the ids in the set of the group
+func (s *Redis) Members(group string) ([]string, error) {
+	return s.MembersContext(context.Background(), group)
+}
+
+// MembersContext is the context aware version of Members
+func (s *Redis) MembersContext(ctx context.Context, group string) ([]string, error) {
+	return s.members(ctx, s.groupKey(group))
+}
+
+// SubscribeGroup creates a subscription to the status changes of the members
+// of the group. Members are kept in memory for every subscribed group and
+// updated with the changes published by Join and Leave
+func (s *Redis) SubscribeGroup(group string, opts ...SubscribeOption) (*Subscription, error) {
+	return s.SubscribeGroupContext(context.Background(), group, opts...)
+}
+
+// SubscribeGroupContext is the context aware version of SubscribeGroup
+func (s *Redis) SubscribeGroupContext(ctx context.Context, group string, opts ...SubscribeOption) (*Subscription, error) {
+	members := s.acquireGroup(group)
+
+	opts = append(opts[:len(opts):len(opts)],
+		withFilter(members.has),
+		withOnClose(func() { s.releaseGroup(group) }),
+	)
+
+	sub, err := s.SubscribeContext(ctx, opts...)
+	if err != nil {
+		s.releaseGroup(group)
+		return nil, err
+	}
+
+	if err := s.loadGroup(ctx, group, members); err != nil {
+		sub.Close()
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+// groupKey returns the key of the set of the group
+func (s *Redis) groupKey(group string) string {
+	return s.prefix + "-group:" + group
+}
+
+// acquireGroup returns the members of the group for a new subscription
+func (s *Redis) acquireGroup(group string) *groupMembers {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	members, ok := s.groups[group]
+	if !ok {
+		members = &groupMembers{ids: make(map[string]struct{})}
+		s.groups[group] = members
+	}
+
+	members.refs++
+	return members
+}
+
+// releaseGroup drops the members of the group with its last subscription
+func (s *Redis) releaseGroup(group string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	members, ok := s.groups[group]
+	if !ok {
+		return
+	}
+
+	if members.refs--; members.refs == 0 {
+		delete(s.groups, group)
+	}
+}
+
+// loadGroup loads the members of the group unless they are loaded already.
+// Members are read after the pubsub connection subscribes to the changes, so
+// the changes after reading them are not missed
+func (s *Redis) loadGroup(ctx context.Context, group string, members *groupMembers) error {
+	members.load.Lock()
+	defer members.load.Unlock()
+
+	for {
+		loaded, gen := members.state()
+		if loaded {
+			return nil
+		}
+
+		s.mu.Lock()
+		ready := s.ready
+		s.mu.Unlock()
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.done:
+			return ErrClosed
+		}
+
+		ids, err := s.MembersContext(ctx, group)
+		if err != nil {
+			return err
+		}
+
+		if members.reset(ids, gen) {
+			return nil
+		}
+	}
+}
+
+// reloadGroups loads the members of the subscribed groups again, changes may
+// be missed while the subscription is dropped
+func (s *Redis) reloadGroups() {
+	s.mu.Lock()
+	groups := make(map[string]*groupMembers, len(s.groups))
+	for group, members := range s.groups {
+		groups[group] = members
+	}
+	s.mu.Unlock()
+
+	for group, members := range groups {
+		members.invalidate()
+
+		go func(group string, members *groupMembers) {
+			err := s.loadGroup(context.Background(), group, members)
+			if err != nil && !s.isClosed() {
+				s.reportError(err)
+			}
+		}(group, members)
+	}
+}
+
+// changeMembership applies the membership change published by Join or Leave
+// to the members of the group, if it is subscribed
+func (s *Redis) changeMembership(n gredis.PMessage) {
+	group := strings.TrimPrefix(n.Channel, s.groupKey(""))
+
+	s.mu.Lock()
+	members, ok := s.groups[group]
+	s.mu.Unlock()
+
+	if ok {
+		members.change(string(n.Data))
+	}
+}
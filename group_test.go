@@ -0,0 +1,276 @@
+package presence
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	gredis "github.com/garyburd/redigo/redis"
+)
+
+func TestMemoryGroups(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		group := <-nextID
+		id1, id2, id3 := <-nextID, <-nextID, <-nextID
+
+		if err := s.Join(group, id1, id2, id3); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Leave(group, id3); err != nil {
+			t.Fatal(err)
+		}
+
+		members, err := s.Members(group)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedMembers := []string{id1, id2}
+		sort.Strings(expectedMembers)
+		if fmt.Sprint(members) != fmt.Sprint(expectedMembers) {
+			t.Fatalf("members should be %s and %s, but got: %v", id1, id2, members)
+		}
+
+		if err := s.SetStatus(Away, id2, id3); err != nil {
+			t.Fatal(err)
+		}
+
+		status, err := s.GroupStatus(group)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]Status{id1: Offline, id2: Away}
+		if len(status) != len(expected) {
+			t.Fatalf("there should be %d statuses, but got: %v", len(expected), status)
+		}
+
+		for _, st := range status {
+			if st.Status != expected[st.ID] {
+				t.Fatalf("status of %s should be %s, but got: %s", st.ID, expected[st.ID], st.Status)
+			}
+		}
+
+		online, total, err := s.GroupOnlineCount(group)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if online != 1 || total != 2 {
+			t.Fatalf("1 of 2 members should be online, but got: %d of %d", online, total)
+		}
+
+		// invisible members are not exposed by the count
+		if err := s.SetStatus(Invisible, id1); err != nil {
+			t.Fatal(err)
+		}
+
+		if online, total, err = s.GroupOnlineCount(group); err != nil || online != 1 || total != 2 {
+			t.Fatalf("1 of 2 members should be online, but got: %d of %d %v", online, total, err)
+		}
+
+		if online, total, err = s.GroupOnlineCount(<-nextID); err != nil || online != 0 || total != 0 {
+			t.Fatalf("empty group should not have members, but got: %d of %d %v", online, total, err)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemorySubscribeGroup(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		group := <-nextID
+		member, other := <-nextID, <-nextID
+
+		if err := s.Join(group, member); err != nil {
+			t.Fatal(err)
+		}
+
+		sub, err := s.SubscribeGroup(group, WithBuffer(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Online(other, member); err != nil {
+			t.Fatal(err)
+		}
+
+		expectEvent(t, sub.Events(), Event{ID: member, Status: Online})
+		expectEvent(t, sub.Events(), Event{ID: member, Status: Offline})
+		expectNoEvent(t, sub.Events())
+
+		// joins after the subscription are followed
+		if err := s.Join(group, other); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Leave(group, member); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Online(member, other); err != nil {
+			t.Fatal(err)
+		}
+
+		expectEvent(t, sub.Events(), Event{ID: other, Status: Online})
+		expectEvent(t, sub.Events(), Event{ID: other, Status: Offline})
+		expectNoEvent(t, sub.Events())
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupMembers(t *testing.T) {
+	members := &groupMembers{ids: make(map[string]struct{})}
+	_, gen := members.state()
+
+	// changes that arrive while loading are applied on top of the loaded ids
+	members.change("+id1")
+	members.change("-id2")
+	members.change("+id3")
+	members.change("-id3")
+
+	if !members.reset([]string{"id2", "id3", "id4"}, gen) {
+		t.Fatal("members should be loaded")
+	}
+
+	for id, expected := range map[string]bool{"id1": true, "id2": false, "id3": false, "id4": true} {
+		if members.has(Event{ID: id}) != expected {
+			t.Fatalf("membership of %s should be %t", id, expected)
+		}
+	}
+
+	members.change("-id1")
+	if members.has(Event{ID: "id1"}) {
+		t.Fatal("id1 should leave the loaded members")
+	}
+
+	// members that are invalidated while loading are loaded again
+	_, gen = members.state()
+	members.invalidate()
+	if members.reset(nil, gen) {
+		t.Fatal("invalidated members should not be loaded")
+	}
+}
+
+func TestGroups(t *testing.T) {
+	err := withConn(func(s *Session) {
+		group := <-nextID
+		member, other := <-nextID, <-nextID
+
+		if err := s.Join(group, member); err != nil {
+			t.Fatal(err)
+		}
+
+		sub, err := s.SubscribeGroup(group, WithBuffer(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Online(other, member); err != nil {
+			t.Fatal(err)
+		}
+
+		expectRedisEvent(t, sub.Events(), Event{ID: member, Status: Online})
+
+		online, total, err := s.GroupOnlineCount(group)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if online != 1 || total != 1 {
+			t.Fatalf("1 of 1 members should be online, but got: %d of %d", online, total)
+		}
+
+		// joins of the other sessions are followed as well
+		err = withConn(func(o *Session) {
+			if err := o.Join(group, other); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.SetStatus(Busy, other); err != nil {
+			t.Fatal(err)
+		}
+
+		expectRedisEvent(t, sub.Events(), Event{ID: other, Status: Busy})
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseWithGroupSubscription(t *testing.T) {
+	// backend is never connected, the group subscription waits for its
+	// members until the backend is closed
+	s := &Redis{
+		pool: &gredis.Pool{Dial: func() (gredis.Conn, error) {
+			return nil, errors.New("no server")
+		}},
+		groups:  make(map[string]*groupMembers),
+		errChan: make(chan error, 1),
+		done:    make(chan struct{}),
+		hub:     newHub(),
+	}
+
+	subscribed := make(chan error, 1)
+	go func() {
+		_, err := s.SubscribeGroup("room")
+		subscribed <- err
+	}()
+
+	// wait for the subscription to be registered
+	for {
+		s.mu.Lock()
+		ok := s.psc != nil
+		s.mu.Unlock()
+
+		if ok {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- s.Close()
+	}()
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(testTimeoutDuration):
+		t.Fatal("close should not block while a group subscription is open")
+	}
+
+	if err := <-subscribed; err != ErrClosed {
+		t.Fatalf("err should be %s, but got: %v", ErrClosed, err)
+	}
+}
+
+// expectRedisEvent fails if the next event of the channel is not the expected
+// one, redis events take longer than the memory ones
+func expectRedisEvent(t *testing.T, events chan Event, expected Event) {
+	select {
+	case e := <-events:
+		if e.ID != expected.ID || e.Status != expected.Status {
+			t.Fatalf("event should be %v, but got: %v", expected, e)
+		}
+	case <-time.After(testTimeoutDuration * 3):
+		t.Fatalf("timed out waiting for %v", expected)
+	}
+}
@@ -0,0 +1,469 @@
+package presence
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Policy decides what happens to the events of a subscription when its buffer
+// is full because the events are not read fast enough
+type Policy int
+
+const (
+	// Block waits until the event is read, a subscription that is not read
+	// blocks the other subscriptions of the backend and eventually the
+	// connection
+	Block Policy = iota
+
+	// DropOldest drops the oldest buffered event to make room for the event
+	DropOldest
+
+	// DropNewest drops the event
+	DropNewest
+
+	// Coalesce keeps only the latest status of every id that is not read yet,
+	// the older statuses of the id are dropped. Ids that are waiting to be
+	// read are kept out of the buffer without a limit
+	Coalesce
+)
+
+// SubscribeOption configures a Subscription
+type SubscribeOption func(*subscribeConfig)
+
+// subscribeConfig holds the settings of a Subscription
+type subscribeConfig struct {
+	// buffer is the buffer size of the events channel
+	buffer int
+
+	// policy is applied when the buffer is full
+	policy Policy
+
+	// debounce is the grace period of the offline events
+	debounce time.Duration
+
+	// filter drops the events that it returns false for, e.g. the events of
+	// the ids that are not in a group
+	filter func(Event) bool
+
+	// onClose is called once when the subscription is closed
+	onClose func()
+}
+
+// WithBuffer sets the buffer size of the events channel of the subscription,
+// the channel is unbuffered by default
+func WithBuffer(size int) SubscribeOption {
+	return func(c *subscribeConfig) {
+		if size < 0 {
+			size = 0
+		}
+
+		c.buffer = size
+	}
+}
+
+// WithPolicy sets the policy that is applied when the events channel of the
+// subscription is full, Block is the default
+func WithPolicy(policy Policy) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.policy = policy
+	}
+}
+
+// WithDebounce holds the offline events of the subscription for the given
+// grace period. If the id comes back before the period ends, the offline
+// event is dropped, and so is the returning event if the status of the id is
+// the same as before. Flapping ids produce only their stable transitions
+func WithDebounce(d time.Duration) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.debounce = d
+	}
+}
+
+// withFilter sends only the events that the filter returns true for
+func withFilter(filter func(Event) bool) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.filter = filter
+	}
+}
+
+// withOnClose calls the given function once when the subscription is closed
+func withOnClose(f func()) SubscribeOption {
+	return func(c *subscribeConfig) {
+		c.onClose = f
+	}
+}
+
+// Subscription receives the status changes of a backend independently from
+// the other subscriptions of it. Events are sent to every subscription in
+// order, see Policy for the subscriptions that are not read fast enough
+type Subscription struct {
+	// dropped is the number of the dropped events, it is first for the
+	// alignment of the atomic operations
+	dropped uint64
+
+	// hub that the subscription is registered to, nil for the subscriptions
+	// that are fed by their owners
+	hub *hub
+
+	// policy is applied when the events channel is full
+	policy Policy
+
+	// filter and onClose are set by the backends, see subscribeConfig
+	filter  func(Event) bool
+	onClose func()
+
+	// events are sent while holding mu, done is closed first when the
+	// subscription is closed to unblock the sender
+	events chan Event
+	done   chan struct{}
+	once   sync.Once
+	closed bool
+	mu     sync.Mutex
+
+	// latest statuses of the coalesced ids in the order of their first event,
+	// they are sent by the forwarder that is woken up with notify
+	latest map[string]Event
+	order  []string
+	notify chan struct{}
+
+	// debounce is the grace period of the offline events. timers holds the
+	// held offline events and last holds the last delivered status of the
+	// non-offline ids, they are guarded by dmu
+	debounce time.Duration
+	timers   map[string]*time.Timer
+	last     map[string]Status
+	dmu      sync.Mutex
+}
+
+// newSubscription creates a subscription with the given options
+func newSubscription(opts []SubscribeOption) *Subscription {
+	conf := &subscribeConfig{}
+	for _, opt := range opts {
+		opt(conf)
+	}
+
+	s := &Subscription{
+		policy:  conf.policy,
+		filter:  conf.filter,
+		onClose: conf.onClose,
+		events:  make(chan Event, conf.buffer),
+		done:    make(chan struct{}),
+	}
+
+	if s.policy == Coalesce {
+		s.latest = make(map[string]Event)
+		s.notify = make(chan struct{}, 1)
+		go s.forward()
+	}
+
+	if conf.debounce > 0 {
+		s.debounce = conf.debounce
+		s.timers = make(map[string]*time.Timer)
+		s.last = make(map[string]Status)
+	}
+
+	return s
+}
+
+// Events returns the channel that the status changes are sent to. The channel
+// is closed when the subscription or the backend is closed
+func (s *Subscription) Events() chan Event {
+	return s.events
+}
+
+// Close stops the subscription and closes its channel, other subscriptions
+// of the backend are not affected
+func (s *Subscription) Close() error {
+	if s.hub != nil {
+		s.hub.unsubscribe(s)
+	}
+
+	s.close()
+	return nil
+}
+
+// Dropped returns the number of the events that are dropped by the policy of
+// the subscription
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// send delivers the event, offline events are held for the grace period if
+// debouncing is enabled
+func (s *Subscription) send(e Event) {
+	if s.filter != nil && !s.filter(e) {
+		return
+	}
+
+	if s.debounce == 0 {
+		s.deliver(e)
+		return
+	}
+
+	// events are delivered while holding the lock to keep their order
+	s.dmu.Lock()
+	defer s.dmu.Unlock()
+
+	if e.Status == Offline {
+		if _, ok := s.timers[e.ID]; ok {
+			return
+		}
+
+		// deliver the offline event after the grace period, unless the id
+		// comes back meanwhile
+		var timer *time.Timer
+		timer = time.AfterFunc(s.debounce, func() {
+			s.dmu.Lock()
+			defer s.dmu.Unlock()
+
+			if s.timers[e.ID] != timer {
+				return
+			}
+
+			delete(s.timers, e.ID)
+			delete(s.last, e.ID)
+			s.deliver(e)
+		})
+		s.timers[e.ID] = timer
+		return
+	}
+
+	if timer, ok := s.timers[e.ID]; ok {
+		timer.Stop()
+		delete(s.timers, e.ID)
+
+		// id is back before the grace period ends, nothing changed
+		if status, ok := s.last[e.ID]; ok && status == e.Status {
+			return
+		}
+	}
+
+	s.last[e.ID] = e.Status
+	s.deliver(e)
+}
+
+// deliver sends the event according to the policy, only Block waits until the
+// event is read or the subscription is closed
+func (s *Subscription) deliver(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	switch s.policy {
+	case DropOldest:
+		for {
+			select {
+			case s.events <- e:
+				return
+			default:
+			}
+
+			// unbuffered channels do not have an older event to drop
+			if cap(s.events) == 0 {
+				atomic.AddUint64(&s.dropped, 1)
+				return
+			}
+
+			// the reader may take the oldest one meanwhile
+			select {
+			case <-s.events:
+				atomic.AddUint64(&s.dropped, 1)
+			default:
+			}
+		}
+	case DropNewest:
+		select {
+		case s.events <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	case Coalesce:
+		if _, ok := s.latest[e.ID]; ok {
+			s.latest[e.ID] = e
+			atomic.AddUint64(&s.dropped, 1)
+			return
+		}
+
+		s.latest[e.ID] = e
+		s.order = append(s.order, e.ID)
+
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	default:
+		select {
+		case s.events <- e:
+		case <-s.done:
+		}
+	}
+}
+
+// forward sends the coalesced events until the subscription is closed, then
+// closes the channel. It is the only sender of the coalescing subscriptions
+func (s *Subscription) forward() {
+	defer close(s.events)
+
+	for {
+		select {
+		case <-s.notify:
+		case <-s.done:
+			return
+		}
+
+		for {
+			s.mu.Lock()
+			if len(s.order) == 0 {
+				s.mu.Unlock()
+				break
+			}
+
+			// newer events of the id are queued again while it is being sent
+			id := s.order[0]
+			e := s.latest[id]
+			s.order = s.order[1:]
+			delete(s.latest, id)
+			s.mu.Unlock()
+
+			select {
+			case s.events <- e:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+// close closes the channel of the subscription once
+func (s *Subscription) close() {
+	s.once.Do(func() {
+		close(s.done)
+
+		s.mu.Lock()
+		s.closed = true
+
+		// forwarder closes the channel of the coalescing subscriptions
+		if s.policy != Coalesce {
+			close(s.events)
+		}
+		s.mu.Unlock()
+
+		// held offline events are not delivered anymore
+		s.dmu.Lock()
+		for _, timer := range s.timers {
+			timer.Stop()
+		}
+		s.dmu.Unlock()
+
+		if s.onClose != nil {
+			s.onClose()
+		}
+	})
+}
+
+// hub broadcasts the status changes of a backend to its subscriptions, so any
+// number of them can share the same source of events
+type hub struct {
+	// subs holds the open subscriptions
+	subs map[*Subscription]struct{}
+
+	// closed is true when the backend is closed
+	closed bool
+
+	mu sync.Mutex
+}
+
+// newHub creates a hub without any subscriptions
+func newHub() *hub {
+	return &hub{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// subscribe registers a new subscription, it is closed when the context is
+// done
+func (h *hub) subscribe(ctx context.Context, opts []SubscribeOption) (*Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, ErrClosed
+	}
+
+	sub := newSubscription(opts)
+	sub.hub = h
+	h.subs[sub] = struct{}{}
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				sub.Close()
+			case <-sub.done:
+			}
+		}()
+	}
+
+	return sub, nil
+}
+
+// unsubscribe removes the subscription from the hub
+func (h *hub) unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subs, sub)
+}
+
+// listening reports whether there is any subscription
+func (h *hub) listening() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.subs) > 0
+}
+
+// publish sends the event to every subscription
+func (h *hub) publish(e Event) {
+	h.mu.Lock()
+	subs := make([]*Subscription, 0, len(h.subs))
+	for sub := range h.subs {
+		subs = append(subs, sub)
+	}
+	h.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.send(e)
+	}
+}
+
+// close closes every subscription, new subscriptions are not accepted
+// afterwards
+func (h *hub) close() {
+	h.mu.Lock()
+	h.closed = true
+	subs := h.subs
+	h.subs = make(map[*Subscription]struct{})
+	h.mu.Unlock()
+
+	for sub := range subs {
+		sub.close()
+	}
+}
+
+// closedEvents returns a closed events channel for the listeners that can not
+// subscribe
+func closedEvents() chan Event {
+	events := make(chan Event)
+	close(events)
+	return events
+}
@@ -0,0 +1,330 @@
+package presence
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemorySubscribeMultiple(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		sub1, err := s.Subscribe()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sub2, err := s.Subscribe(WithBuffer(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id := <-nextID
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		expectEvent(t, sub1.Events(), Event{ID: id, Status: Online})
+		expectEvent(t, sub2.Events(), Event{ID: id, Status: Online})
+
+		// closing one of them does not affect the other
+		if err := sub1.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := <-sub1.Events(); ok {
+			t.Fatal("channel of the closed subscription should be closed")
+		}
+
+		expectEvent(t, sub2.Events(), Event{ID: id, Status: Offline})
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemorySubscribeBuffer(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		sub, err := s.Subscribe(WithBuffer(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id1, id2 := <-nextID, <-nextID
+		if err := s.Online(id1, id2); err != nil {
+			t.Fatal(err)
+		}
+
+		// events are buffered without a reader
+		time.Sleep(testMemoryTimeoutDuration / 2)
+		if l := len(sub.Events()); l != 2 {
+			t.Fatalf("there should be 2 buffered events, but got: %d", l)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemorySubscribeContext(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		sub, err := s.SubscribeContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cancel()
+
+		select {
+		case _, ok := <-sub.Events():
+			if ok {
+				t.Fatal("channel should be closed")
+			}
+		case <-time.After(testMemoryTimeoutDuration):
+			t.Fatal("timed out waiting for the channel to be closed")
+		}
+
+		if _, err := s.SubscribeContext(ctx); err != context.Canceled {
+			t.Fatalf("err should be %s, but got: %v", context.Canceled, err)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemorySubscribeClose(t *testing.T) {
+	backend, err := NewMemory(testMemoryTimeoutDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subs := make([]*Subscription, 2)
+	for i := range subs {
+		if subs[i], err = backend.Subscribe(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := backend.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sub := range subs {
+		if _, ok := <-sub.Events(); ok {
+			t.Fatal("channel should be closed with the backend")
+		}
+	}
+
+	if _, err := backend.Subscribe(); err != ErrClosed {
+		t.Fatalf("err should be %s, but got: %v", ErrClosed, err)
+	}
+}
+
+// sendAll sends the events to the subscription directly
+func sendAll(sub *Subscription, events ...Event) {
+	for _, e := range events {
+		sub.send(e)
+	}
+}
+
+// receiveAll reads the given number of events from the subscription
+func receiveAll(t *testing.T, sub *Subscription, n int) []Event {
+	events := make([]Event, 0, n)
+	for len(events) < n {
+		select {
+		case e := <-sub.Events():
+			events = append(events, e)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after %d events, expected %d", len(events), n)
+		}
+	}
+
+	return events
+}
+
+func TestSubscriptionPolicies(t *testing.T) {
+	e1 := Event{ID: "id1", Status: Online}
+	e2 := Event{ID: "id2", Status: Online}
+	e3 := Event{ID: "id1", Status: Away}
+
+	tests := []struct {
+		policy   Policy
+		expected []Event
+		dropped  uint64
+	}{
+		{DropOldest, []Event{e2, e3}, 1},
+		{DropNewest, []Event{e1, e2}, 1},
+	}
+
+	for _, test := range tests {
+		sub := newSubscription([]SubscribeOption{WithBuffer(2), WithPolicy(test.policy)})
+		sendAll(sub, e1, e2, e3)
+
+		if dropped := sub.Dropped(); dropped != test.dropped {
+			t.Fatalf("%d events should be dropped with policy %d, but got: %d", test.dropped, test.policy, dropped)
+		}
+
+		events := receiveAll(t, sub, len(test.expected))
+		for i, e := range events {
+			if e != test.expected[i] {
+				t.Fatalf("events should be %v with policy %d, but got: %v", test.expected, test.policy, events)
+			}
+		}
+
+		sub.Close()
+		if _, ok := <-sub.Events(); ok {
+			t.Fatalf("channel should be closed with policy %d", test.policy)
+		}
+	}
+}
+
+func TestSubscriptionCoalesce(t *testing.T) {
+	e1 := Event{ID: "id1", Status: Online}
+	e2 := Event{ID: "id2", Status: Online}
+	e3 := Event{ID: "id1", Status: Away}
+	e4 := Event{ID: "id2", Status: Busy}
+
+	sub := newSubscription([]SubscribeOption{WithPolicy(Coalesce)})
+
+	// wait for the forwarder to block on the first event
+	sendAll(sub, e1)
+	time.Sleep(time.Millisecond * 10)
+
+	// ids are delivered in the order of their first waiting event
+	sendAll(sub, e2, e3, e4)
+
+	if dropped := sub.Dropped(); dropped != 1 {
+		t.Fatalf("1 event should be dropped, but got: %d", dropped)
+	}
+
+	expected := []Event{e1, e4, e3}
+	events := receiveAll(t, sub, len(expected))
+	for i, e := range events {
+		if e != expected[i] {
+			t.Fatalf("events should be %v, but got: %v", expected, events)
+		}
+	}
+
+	sub.Close()
+	if _, ok := <-sub.Events(); ok {
+		t.Fatal("channel should be closed")
+	}
+}
+
+func TestSubscriptionUnbuffered(t *testing.T) {
+	for _, policy := range []Policy{DropOldest, DropNewest} {
+		sub := newSubscription([]SubscribeOption{WithPolicy(policy)})
+		sendAll(sub, Event{ID: "id1", Status: Online})
+
+		if dropped := sub.Dropped(); dropped != 1 {
+			t.Fatalf("event should be dropped without a reader with policy %d, but got: %d", policy, dropped)
+		}
+
+		sub.Close()
+	}
+}
+
+func TestMemorySubscribeCoalesce(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		sub, err := s.Subscribe(WithPolicy(Coalesce))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id := <-nextID
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		// wait for the forwarder to block on the online event
+		time.Sleep(time.Millisecond * 10)
+
+		if err := s.SetStatus(Away, id); err != nil {
+			t.Fatal(err)
+		}
+
+		// wait for the offline event without reading, it replaces away
+		time.Sleep(testMemoryTimeoutDuration * 3)
+
+		expectEvent(t, sub.Events(), Event{ID: id, Status: Online})
+		expectEvent(t, sub.Events(), Event{ID: id, Status: Offline})
+		expectNoEvent(t, sub.Events())
+
+		if dropped := sub.Dropped(); dropped != 1 {
+			t.Fatalf("1 event should be dropped, but got: %d", dropped)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubscriptionDebounce(t *testing.T) {
+	grace := time.Millisecond * 50
+	sub := newSubscription([]SubscribeOption{WithBuffer(10), WithDebounce(grace)})
+	defer sub.Close()
+
+	flapping := Event{ID: "id1", Status: Online}
+	changed := Event{ID: "id2", Status: Online}
+	leaving := Event{ID: "id3", Status: Online}
+	sendAll(sub, flapping, changed, leaving)
+	receiveAll(t, sub, 3)
+
+	// flapping id comes back with the same status, changed one with another
+	sendAll(sub,
+		Event{ID: "id1", Status: Offline},
+		Event{ID: "id2", Status: Offline},
+		Event{ID: "id3", Status: Offline},
+		flapping,
+		Event{ID: "id2", Status: Away},
+	)
+
+	expected := []Event{{ID: "id2", Status: Away}, {ID: "id3", Status: Offline}}
+	events := receiveAll(t, sub, len(expected))
+	for i, e := range events {
+		if e != expected[i] {
+			t.Fatalf("events should be %v, but got: %v", expected, events)
+		}
+	}
+
+	select {
+	case e := <-sub.Events():
+		t.Fatalf("there should not be any event, but got: %v", e)
+	case <-time.After(grace * 2):
+	}
+}
+
+func TestMemorySubscribeDebounce(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		sub, err := s.Subscribe(WithDebounce(testMemoryTimeoutDuration))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id := <-nextID
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		expectEvent(t, sub.Events(), Event{ID: id, Status: Online})
+
+		// expire and come back within the grace period
+		time.Sleep(testMemoryTimeoutDuration + testMemoryTimeoutDuration/2)
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		expectNoEvent(t, sub.Events())
+		expectEvent(t, sub.Events(), Event{ID: id, Status: Offline})
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
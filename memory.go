@@ -0,0 +1,962 @@
+package presence
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrClosed for stating the backend is already closed
+	ErrClosed = errors.New("backend is closed")
+
+	// ErrInvalidDuration for stating the inactive duration is not usable
+	ErrInvalidDuration = errors.New("invalid inactive duration")
+
+	// ErrInvalidLimit for stating the page size of a listing is not positive
+	ErrInvalidLimit = errors.New("limit should be positive")
+)
+
+// Memory is an in-process presence backend. It has the same semantics with
+// the Redis backend, but keeps the data in memory and expires the ids with a
+// timer instead of keyspace notifications, so it can be used in tests and in
+// single node deployments
+type Memory struct {
+	// inactiveDuration specifies no-probe allowance time
+	inactiveDuration time.Duration
+
+	// items holds the online ids
+	items map[string]*memoryItem
+
+	// queue orders the items by their expiration time
+	queue expiryQueue
+
+	// lastSeen holds the last time the ids are seen
+	lastSeen map[string]time.Time
+
+	// seq holds the sequence number of the last transition of the ids
+	seq map[string]int64
+
+	// groups holds the members of the groups
+	groups map[string]map[string]struct{}
+
+	// contacts holds the rosters of the ids, watchers holds the reverse of it
+	contacts map[string]map[string]struct{}
+	watchers map[string]map[string]struct{}
+
+	// pending holds the events that are not delivered to the listeners yet
+	pending []Event
+
+	// hub broadcasts the events to the subscriptions
+	hub *hub
+
+	// errChan pipe all errors  the this channel
+	errChan chan error
+
+	// notify wakes up the expiry loop
+	notify chan struct{}
+
+	// done is closed when the backend is closed
+	done chan struct{}
+
+	// stopped is closed when the expiry loop exits
+	stopped chan struct{}
+
+	// closed holds the status of the backend
+	closed bool
+
+	// lock for Memory struct
+	mu sync.Mutex
+}
+
+// memoryItem holds the presence data of an id
+type memoryItem struct {
+	id       string
+	status   Status
+	expireAt time.Time
+
+	// devices holds the expiration times of the devices of the id
+	devices map[string]time.Time
+
+	// index is the position of the item in the expiry queue
+	index int
+}
+
+// NewMemory creates an in-memory presence system
+func NewMemory(inactiveDuration time.Duration) (Backend, error) {
+	if inactiveDuration <= 0 {
+		return nil, ErrInvalidDuration
+	}
+
+	m := &Memory{
+		inactiveDuration: inactiveDuration,
+		items:            make(map[string]*memoryItem),
+		lastSeen:         make(map[string]time.Time),
+		seq:              make(map[string]int64),
+		groups:           make(map[string]map[string]struct{}),
+		contacts:         make(map[string]map[string]struct{}),
+		watchers:         make(map[string]map[string]struct{}),
+		hub:              newHub(),
+		errChan:          make(chan error, 1),
+		notify:           make(chan struct{}, 1),
+		done:             make(chan struct{}),
+		stopped:          make(chan struct{}),
+	}
+
+	go m.run()
+
+	return m, nil
+}
+
+// Online resets the expiration time for any given id. If the id does not
+// exist, it becomes online and an Online event is sent to the listener
+func (m *Memory) Online(ids ...string) error {
+	return m.OnlineContext(context.Background(), ids...)
+}
+
+// OnlineContext is the context aware version of Online
+func (m *Memory) OnlineContext(ctx context.Context, ids ...string) error {
+	return m.OnlineTTLContext(ctx, m.inactiveDuration, ids...)
+}
+
+// OnlineTTL is the same as Online, but the ids expire after the given duration
+// instead of the inactive duration of the backend
+func (m *Memory) OnlineTTL(ttl time.Duration, ids ...string) error {
+	return m.OnlineTTLContext(context.Background(), ttl, ids...)
+}
+
+// OnlineTTLContext is the context aware version of OnlineTTL
+func (m *Memory) OnlineTTLContext(ctx context.Context, ttl time.Duration, ids ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if ttl <= 0 {
+		return ErrInvalidDuration
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	now := time.Now()
+	expireAt := now.Add(ttl)
+	for _, id := range ids {
+		m.lastSeen[id] = now
+
+		if item, ok := m.items[id]; ok {
+			item.expireAt = expireAt
+			heap.Fix(&m.queue, item.index)
+			continue
+		}
+
+		m.add(id, Online, expireAt)
+	}
+
+	m.wakeup()
+	return nil
+}
+
+// SetStatus sets the status of given ids and resets their expiration time. An
+// event is sent to the listener only if the status of the id changes
+func (m *Memory) SetStatus(status Status, ids ...string) error {
+	return m.SetStatusContext(context.Background(), status, ids...)
+}
+
+// SetStatusContext is the context aware version of SetStatus
+func (m *Memory) SetStatusContext(ctx context.Context, status Status, ids ...string) error {
+	return m.SetStatusTTLContext(ctx, status, m.inactiveDuration, ids...)
+}
+
+// SetStatusTTL is the same as SetStatus, but the ids expire after the given
+// duration instead of the inactive duration of the backend
+func (m *Memory) SetStatusTTL(status Status, ttl time.Duration, ids ...string) error {
+	return m.SetStatusTTLContext(context.Background(), status, ttl, ids...)
+}
+
+// SetStatusTTLContext is the context aware version of SetStatusTTL
+func (m *Memory) SetStatusTTLContext(ctx context.Context, status Status, ttl time.Duration, ids ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if !status.isSettable() {
+		return ErrInvalidStatus
+	}
+
+	if ttl <= 0 {
+		return ErrInvalidDuration
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	now := time.Now()
+	expireAt := now.Add(ttl)
+	for _, id := range ids {
+		m.lastSeen[id] = now
+
+		item, ok := m.items[id]
+		if !ok {
+			m.add(id, status, expireAt)
+			continue
+		}
+
+		item.expireAt = expireAt
+		heap.Fix(&m.queue, item.index)
+
+		if item.status != status {
+			m.transition(id, item.status, status, now, true)
+			item.status = status
+		}
+	}
+
+	m.wakeup()
+	return nil
+}
+
+// Offline sets given ids as offline with all of their devices and records the
+// current time as their last seen time. Like the Redis backend, explicitly
+// removed ids generate an Offline event as the expired ones do
+func (m *Memory) Offline(ids ...string) error {
+	return m.OfflineContext(context.Background(), ids...)
+}
+
+// OfflineContext is the context aware version of Offline
+func (m *Memory) OfflineContext(ctx context.Context, ids ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	now := time.Now()
+	for _, id := range ids {
+		m.lastSeen[id] = now
+
+		item, ok := m.items[id]
+		if !ok {
+			continue
+		}
+
+		m.remove(item)
+	}
+
+	m.wakeup()
+	return nil
+}
+
+// OnlineDevice resets the expiration time of the given device of the id. The
+// id stays online as long as any of its devices is online
+func (m *Memory) OnlineDevice(id, device string) error {
+	return m.OnlineDeviceContext(context.Background(), id, device)
+}
+
+// OnlineDeviceContext is the context aware version of OnlineDevice
+func (m *Memory) OnlineDeviceContext(ctx context.Context, id, device string) error {
+	return m.OnlineDeviceTTLContext(ctx, m.inactiveDuration, id, device)
+}
+
+// OnlineDeviceTTL is the same as OnlineDevice, but the device expires after the
+// given duration instead of the inactive duration of the backend
+func (m *Memory) OnlineDeviceTTL(ttl time.Duration, id, device string) error {
+	return m.OnlineDeviceTTLContext(context.Background(), ttl, id, device)
+}
+
+// OnlineDeviceTTLContext is the context aware version of OnlineDeviceTTL
+func (m *Memory) OnlineDeviceTTLContext(ctx context.Context, ttl time.Duration, id, device string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if ttl <= 0 {
+		return ErrInvalidDuration
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	now := time.Now()
+	m.lastSeen[id] = now
+
+	item, ok := m.items[id]
+	if !ok {
+		item = m.add(id, Online, now.Add(ttl))
+	}
+
+	if item.devices == nil {
+		item.devices = make(map[string]time.Time)
+	}
+
+	item.devices[device] = now.Add(ttl)
+	m.updateDevices(item, now)
+
+	m.wakeup()
+	return nil
+}
+
+// OfflineDevice sets the given device of the id as offline. The id becomes
+// offline only if it has no other online devices
+func (m *Memory) OfflineDevice(id, device string) error {
+	return m.OfflineDeviceContext(context.Background(), id, device)
+}
+
+// OfflineDeviceContext is the context aware version of OfflineDevice
+func (m *Memory) OfflineDeviceContext(ctx context.Context, id, device string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	now := time.Now()
+	m.lastSeen[id] = now
+
+	item, ok := m.items[id]
+	if !ok {
+		return nil
+	}
+
+	delete(item.devices, device)
+	m.updateDevices(item, now)
+
+	m.wakeup()
+	return nil
+}
+
+// updateDevices drops the expired devices of the item and sets its expiration
+// time to the latest one of the rest. Item is removed if it has no devices
+// left, must be called with the lock held
+func (m *Memory) updateDevices(item *memoryItem, now time.Time) {
+	var expireAt time.Time
+	for device, deviceExpireAt := range item.devices {
+		if !deviceExpireAt.After(now) {
+			delete(item.devices, device)
+			continue
+		}
+
+		if deviceExpireAt.After(expireAt) {
+			expireAt = deviceExpireAt
+		}
+	}
+
+	if expireAt.IsZero() {
+		m.remove(item)
+		return
+	}
+
+	item.expireAt = expireAt
+	heap.Fix(&m.queue, item.index)
+}
+
+// remove deletes the item and notifies its Offline transition, must be called
+// with the lock held
+func (m *Memory) remove(item *memoryItem) {
+	heap.Remove(&m.queue, item.index)
+	delete(m.items, item.id)
+
+	m.transition(item.id, item.status, Offline, time.Now(), true)
+}
+
+// Status returns the current status of multiple keys from system
+func (m *Memory) Status(ids ...string) ([]Event, error) {
+	return m.StatusContext(context.Background(), ids...)
+}
+
+// StatusContext is the context aware version of Status
+func (m *Memory) StatusContext(ctx context.Context, ids ...string) ([]Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	now := time.Now()
+	res := make([]Event, len(ids))
+	for i, id := range ids {
+		res[i] = Event{ID: id, Status: Offline}
+
+		// the expiry loop may not have processed the item yet
+		if item, ok := m.items[id]; ok && item.expireAt.After(now) {
+			res[i].Status = item.status
+		}
+	}
+
+	return res, nil
+}
+
+// Lookup returns the status, the remaining time to live and the last seen time
+// of the given ids
+func (m *Memory) Lookup(ids ...string) ([]Result, error) {
+	return m.LookupContext(context.Background(), ids...)
+}
+
+// LookupContext is the context aware version of Lookup
+func (m *Memory) LookupContext(ctx context.Context, ids ...string) ([]Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	now := time.Now()
+	res := make([]Result, len(ids))
+	for i, id := range ids {
+		res[i] = Result{ID: id, Status: Offline, LastSeen: m.lastSeen[id]}
+
+		// the expiry loop may not have processed the item yet
+		if item, ok := m.items[id]; ok && item.expireAt.After(now) {
+			res[i].Status = item.status
+			res[i].TTL = item.expireAt.Sub(now)
+		}
+	}
+
+	return res, nil
+}
+
+// LastSeen returns the last time the given ids sent a probe or set as offline.
+// Zero time is returned for the ids that are never seen
+func (m *Memory) LastSeen(ids ...string) ([]time.Time, error) {
+	return m.LastSeenContext(context.Background(), ids...)
+}
+
+// LastSeenContext is the context aware version of LastSeen
+func (m *Memory) LastSeenContext(ctx context.Context, ids ...string) ([]time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	res := make([]time.Time, len(ids))
+	for i, id := range ids {
+		res[i] = m.lastSeen[id]
+	}
+
+	return res, nil
+}
+
+// TTL returns the remaining time until the given ids expire, zero for the
+// offline ids
+func (m *Memory) TTL(ids ...string) ([]time.Duration, error) {
+	return m.TTLContext(context.Background(), ids...)
+}
+
+// TTLContext is the context aware version of TTL
+func (m *Memory) TTLContext(ctx context.Context, ids ...string) ([]time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	now := time.Now()
+	res := make([]time.Duration, len(ids))
+	for i, id := range ids {
+		// the expiry loop may not have processed the item yet
+		if item, ok := m.items[id]; ok && item.expireAt.After(now) {
+			res[i] = item.expireAt.Sub(now)
+		}
+	}
+
+	return res, nil
+}
+
+// Count returns the number of the online ids
+func (m *Memory) Count() (int, error) {
+	return m.CountContext(context.Background())
+}
+
+// CountContext is the context aware version of Count
+func (m *Memory) CountContext(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return 0, ErrClosed
+	}
+
+	return len(m.online(time.Now())), nil
+}
+
+// ListOnline returns the online ids in order, starting after the given cursor.
+// Cursor of the next page is the last returned id, empty if there are no more
+// ids
+func (m *Memory) ListOnline(cursor string, limit int) ([]string, string, error) {
+	return m.ListOnlineContext(context.Background(), cursor, limit)
+}
+
+// ListOnlineContext is the context aware version of ListOnline
+func (m *Memory) ListOnlineContext(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if limit <= 0 {
+		return nil, "", ErrInvalidLimit
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, "", ErrClosed
+	}
+
+	ids := m.online(time.Now())
+	sort.Strings(ids)
+
+	// ids that are added after the cursor are still listed in their place
+	start := sort.SearchStrings(ids, cursor)
+	if start < len(ids) && ids[start] == cursor && cursor != "" {
+		start++
+	}
+
+	ids = ids[start:]
+	if len(ids) <= limit {
+		return ids, "", nil
+	}
+
+	ids = ids[:limit]
+	return ids, ids[limit-1], nil
+}
+
+// Join adds the given ids to the group
+func (m *Memory) Join(group string, ids ...string) error {
+	return m.JoinContext(context.Background(), group, ids...)
+}
+
+// JoinContext is the context aware version of Join
+func (m *Memory) JoinContext(ctx context.Context, group string, ids ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	for _, id := range ids {
+		addToSet(m.groups, group, id)
+	}
+
+	return nil
+}
+
+// Leave removes the given ids from the group
+func (m *Memory) Leave(group string, ids ...string) error {
+	return m.LeaveContext(context.Background(), group, ids...)
+}
+
+// LeaveContext is the context aware version of Leave
+func (m *Memory) LeaveContext(ctx context.Context, group string, ids ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	// groups are gone with their last members, as the sets in redis
+	for _, id := range ids {
+		removeFromSet(m.groups, group, id)
+	}
+
+	return nil
+}
+
+// AddContacts adds the given contacts to the roster of the id
+func (m *Memory) AddContacts(id string, contacts ...string) error {
+	return m.AddContactsContext(context.Background(), id, contacts...)
+}
+
+// AddContactsContext is the context aware version of AddContacts
+func (m *Memory) AddContactsContext(ctx context.Context, id string, contacts ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	for _, contact := range contacts {
+		addToSet(m.contacts, id, contact)
+		addToSet(m.watchers, contact, id)
+	}
+
+	return nil
+}
+
+// RemoveContacts removes the given contacts from the roster of the id
+func (m *Memory) RemoveContacts(id string, contacts ...string) error {
+	return m.RemoveContactsContext(context.Background(), id, contacts...)
+}
+
+// RemoveContactsContext is the context aware version of RemoveContacts
+func (m *Memory) RemoveContactsContext(ctx context.Context, id string, contacts ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	for _, contact := range contacts {
+		removeFromSet(m.contacts, id, contact)
+		removeFromSet(m.watchers, contact, id)
+	}
+
+	return nil
+}
+
+// Contacts returns the roster of the id in order
+func (m *Memory) Contacts(id string) ([]string, error) {
+	return m.ContactsContext(context.Background(), id)
+}
+
+// ContactsContext is the context aware version of Contacts
+func (m *Memory) ContactsContext(ctx context.Context, id string) ([]string, error) {
+	return m.members(ctx, m.contacts, id)
+}
+
+// Watchers returns the ids that have the given id in their rosters in order
+func (m *Memory) Watchers(id string) ([]string, error) {
+	return m.WatchersContext(context.Background(), id)
+}
+
+// WatchersContext is the context aware version of Watchers
+func (m *Memory) WatchersContext(ctx context.Context, id string) ([]string, error) {
+	return m.members(ctx, m.watchers, id)
+}
+
+// members returns the members of the given set in order
+func (m *Memory) members(ctx context.Context, sets map[string]map[string]struct{}, key string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	ids := make([]string, 0, len(sets[key]))
+	for id := range sets[key] {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// addToSet adds the member to the set of the key
+func addToSet(sets map[string]map[string]struct{}, key, member string) {
+	set, ok := sets[key]
+	if !ok {
+		set = make(map[string]struct{})
+		sets[key] = set
+	}
+
+	set[member] = struct{}{}
+}
+
+// removeFromSet removes the member from the set of the key, empty sets are
+// dropped
+func removeFromSet(sets map[string]map[string]struct{}, key, member string) {
+	delete(sets[key], member)
+	if len(sets[key]) == 0 {
+		delete(sets, key)
+	}
+}
+
+// Members returns the ids in the group in order
+func (m *Memory) Members(group string) ([]string, error) {
+	return m.MembersContext(context.Background(), group)
+}
+
+// MembersContext is the context aware version of Members
+func (m *Memory) MembersContext(ctx context.Context, group string) ([]string, error) {
+	return m.members(ctx, m.groups, group)
+}
+
+// SubscribeGroup creates a subscription to the status changes of the members
+// of the group
+func (m *Memory) SubscribeGroup(group string, opts ...SubscribeOption) (*Subscription, error) {
+	return m.SubscribeGroupContext(context.Background(), group, opts...)
+}
+
+// SubscribeGroupContext is the context aware version of SubscribeGroup
+func (m *Memory) SubscribeGroupContext(ctx context.Context, group string, opts ...SubscribeOption) (*Subscription, error) {
+	opts = append(opts[:len(opts):len(opts)], withFilter(func(e Event) bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		_, ok := m.groups[group][e.ID]
+		return ok
+	}))
+
+	return m.hub.subscribe(ctx, opts)
+}
+
+// online returns the ids that are not expired yet, must be called with the
+// lock held
+func (m *Memory) online(now time.Time) []string {
+	ids := make([]string, 0, len(m.items))
+	for id, item := range m.items {
+		// the expiry loop may not have processed the item yet
+		if item.expireAt.After(now) {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// Error returns error if it happens while listening  to status changes
+func (m *Memory) Error() chan error {
+	return m.errChan
+}
+
+// Close stops the expiry loop and closes the event channels
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrClosed
+	}
+
+	m.closed = true
+	m.mu.Unlock()
+
+	// closing the subscriptions unblocks the expiry loop if it is sending
+	m.hub.close()
+	close(m.done)
+
+	<-m.stopped
+
+	return nil
+}
+
+// ListenStatusChanges returns the channel that online and offline status
+// changes are sent to. Every call creates a new subscription, see Subscribe
+func (m *Memory) ListenStatusChanges() chan Event {
+	return m.ListenStatusChangesContext(context.Background())
+}
+
+// ListenStatusChangesContext is the context aware version of
+// ListenStatusChanges. Listening stops and the channel is closed when the
+// context is done or the backend is closed
+func (m *Memory) ListenStatusChangesContext(ctx context.Context) chan Event {
+	sub, err := m.SubscribeContext(ctx)
+	if err != nil {
+		m.reportError(err)
+		return closedEvents()
+	}
+
+	return sub.Events()
+}
+
+// Subscribe creates an independent subscription to the status changes
+func (m *Memory) Subscribe(opts ...SubscribeOption) (*Subscription, error) {
+	return m.SubscribeContext(context.Background(), opts...)
+}
+
+// SubscribeContext is the context aware version of Subscribe, the
+// subscription is closed when the context is done
+func (m *Memory) SubscribeContext(ctx context.Context, opts ...SubscribeOption) (*Subscription, error) {
+	return m.hub.subscribe(ctx, opts)
+}
+
+// reportError sends the error to the error channel without blocking
+func (m *Memory) reportError(err error) {
+	select {
+	case m.errChan <- err:
+	default:
+	}
+}
+
+// add inserts a new item with the given status, must be called with the lock
+// held
+func (m *Memory) add(id string, status Status, expireAt time.Time) *memoryItem {
+	item := &memoryItem{id: id, status: status, expireAt: expireAt}
+	m.items[id] = item
+	heap.Push(&m.queue, item)
+	m.transition(id, Offline, status, time.Now(), true)
+	return item
+}
+
+// transition increments the sequence number of the id and queues the event if
+// notify is true and there is a listener, must be called with the lock held
+func (m *Memory) transition(id string, previous, status Status, t time.Time, notify bool) {
+	m.seq[id]++
+
+	if !notify || !m.hub.listening() {
+		return
+	}
+
+	m.pending = append(m.pending, Event{
+		ID:       id,
+		Status:   status,
+		Previous: previous,
+		Time:     t,
+		Seq:      m.seq[id],
+	})
+}
+
+// wakeup notifies the expiry loop without blocking, must be called with the
+// lock held
+func (m *Memory) wakeup() {
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run expires the items and delivers the pending events until the backend is
+// closed
+func (m *Memory) run() {
+	defer close(m.stopped)
+
+	timer := time.NewTimer(m.inactiveDuration)
+	defer timer.Stop()
+
+	for {
+		m.mu.Lock()
+		wait := m.expire(time.Now())
+		events := m.pending
+		m.pending = nil
+		m.mu.Unlock()
+
+		for _, e := range events {
+			m.hub.publish(e)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-m.notify:
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// expire removes the items that are expired as of now, and returns the
+// duration until the next expiration, must be called with the lock held
+func (m *Memory) expire(now time.Time) time.Duration {
+	for m.queue.Len() > 0 {
+		item := m.queue[0]
+		if item.expireAt.After(now) {
+			return item.expireAt.Sub(now)
+		}
+
+		heap.Pop(&m.queue)
+		delete(m.items, item.id)
+		m.transition(item.id, item.status, Offline, item.expireAt, true)
+	}
+
+	// nothing to expire, sleep until someone wakes us up
+	return m.inactiveDuration
+}
+
+// expiryQueue implements heap.Interface and holds the items ordered by their
+// expiration time
+type expiryQueue []*memoryItem
+
+func (q expiryQueue) Len() int { return len(q) }
+
+func (q expiryQueue) Less(i, j int) bool { return q[i].expireAt.Before(q[j].expireAt) }
+
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *expiryQueue) Push(x interface{}) {
+	item := x.(*memoryItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*q = old[:n-1]
+	return item
+}
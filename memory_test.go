@@ -0,0 +1,593 @@
+package presence
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var testMemoryTimeoutDuration = time.Millisecond * 100
+
+func withMemory(f func(s *Session)) error {
+	backend, err := NewMemory(testMemoryTimeoutDuration)
+	if err != nil {
+		return err
+	}
+
+	s, err := New(backend)
+	if err != nil {
+		return err
+	}
+
+	f(s)
+
+	return s.Close()
+}
+
+func TestMemoryInvalidDuration(t *testing.T) {
+	if _, err := NewMemory(0); err != ErrInvalidDuration {
+		t.Fatalf("err should be %s, but got: %v", ErrInvalidDuration, err)
+	}
+}
+
+func TestMemoryStatus(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		onlineID := <-nextID
+		offlineID := <-nextID
+
+		if err := s.Online(onlineID); err != nil {
+			t.Fatal(err)
+		}
+
+		status, err := s.Status(onlineID, offlineID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status[0].ID != onlineID || status[0].Status != Online {
+			t.Fatalf("%s should be %s, but it is %s", onlineID, Online, status[0].Status)
+		}
+
+		if status[1].ID != offlineID || status[1].Status != Offline {
+			t.Fatalf("%s should be %s, but it is %s", offlineID, Offline, status[1].Status)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemorySetStatus(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		id := <-nextID
+		events := s.ListenStatusChanges()
+
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.SetStatus(Busy, id); err != nil {
+			t.Fatal(err)
+		}
+
+		// setting the same status again should not generate an event
+		if err := s.SetStatus(Busy, id); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.SetStatus(Offline, id); err != ErrInvalidStatus {
+			t.Fatalf("err should be %s, but got: %v", ErrInvalidStatus, err)
+		}
+
+		status, err := s.Status(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status[0].Status != Busy {
+			t.Fatalf("%s should be %s, but it is %s", id, Busy, status[0].Status)
+		}
+
+		for _, expected := range []Status{Online, Busy, Offline} {
+			if event := <-events; event.Status != expected {
+				t.Fatalf("event status should be %s, but it is %s", expected, event.Status)
+			}
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryOffline(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		id := <-nextID
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Offline(id); err != nil {
+			t.Fatal(err)
+		}
+
+		status, err := s.Status(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status[0].Status != Offline {
+			t.Fatalf("%s should be %s, but it is %s", id, Offline, status[0].Status)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryDevices(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		id := <-nextID
+		if err := s.OnlineDevice(id, "phone"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.OnlineDevice(id, "laptop"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.OfflineDevice(id, "phone"); err != nil {
+			t.Fatal(err)
+		}
+
+		status, err := s.Status(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status[0].Status != Online {
+			t.Fatalf("%s should be %s while it has an online device, but it is %s", id, Online, status[0].Status)
+		}
+
+		if err := s.OfflineDevice(id, "laptop"); err != nil {
+			t.Fatal(err)
+		}
+
+		status, err = s.Status(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status[0].Status != Offline {
+			t.Fatalf("%s should be %s without online devices, but it is %s", id, Offline, status[0].Status)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryDeviceExpiration(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		id := <-nextID
+		events := s.ListenStatusChanges()
+
+		if err := s.OnlineDevice(id, "phone"); err != nil {
+			t.Fatal(err)
+		}
+
+		// keep the laptop alive while the phone expires
+		time.Sleep(testMemoryTimeoutDuration / 2)
+		if err := s.OnlineDevice(id, "laptop"); err != nil {
+			t.Fatal(err)
+		}
+
+		if event := <-events; event.Status != Online {
+			t.Fatalf("event status should be %s, but it is %s", Online, event.Status)
+		}
+
+		start := time.Now()
+		if event := <-events; event.Status != Offline {
+			t.Fatalf("event status should be %s, but it is %s", Offline, event.Status)
+		}
+
+		// offline event should only come after the laptop expires
+		if time.Since(start) < testMemoryTimeoutDuration*3/4 {
+			t.Fatalf("%s should be offline after its last device expires", id)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryLastSeen(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		seenID := <-nextID
+		unseenID := <-nextID
+
+		before := time.Now()
+		if err := s.Online(seenID); err != nil {
+			t.Fatal(err)
+		}
+
+		// sleep until expiration
+		time.Sleep(testMemoryTimeoutDuration * 2)
+
+		lastSeen, err := s.LastSeen(seenID, unseenID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if lastSeen[0].Before(before) || lastSeen[0].After(before.Add(testMemoryTimeoutDuration)) {
+			t.Fatalf("%s should be seen at its last probe, but it is seen at %s", seenID, lastSeen[0])
+		}
+
+		if !lastSeen[1].IsZero() {
+			t.Fatalf("%s should not be seen, but it is seen at %s", unseenID, lastSeen[1])
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryLookup(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		onlineID, offlineID := <-nextID, <-nextID
+
+		before := time.Now()
+		if err := s.SetStatus(Busy, onlineID); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := s.Lookup(onlineID, offlineID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res[0].ID != onlineID || res[0].Status != Busy || res[0].Err != nil {
+			t.Fatalf("%s should be busy, but got: %v", onlineID, res[0])
+		}
+
+		if res[0].TTL <= 0 || res[0].TTL > testMemoryTimeoutDuration {
+			t.Fatalf("ttl of %s should be in (0, %s], but got: %s", onlineID, testMemoryTimeoutDuration, res[0].TTL)
+		}
+
+		if res[0].LastSeen.Before(before) {
+			t.Fatalf("%s should be seen after %s, but it is seen at %s", onlineID, before, res[0].LastSeen)
+		}
+
+		if res[1] != (Result{ID: offlineID, Status: Offline}) {
+			t.Fatalf("%s should be offline and never seen, but got: %v", offlineID, res[1])
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryTTL(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		onlineID, offlineID := <-nextID, <-nextID
+		if err := s.Online(onlineID); err != nil {
+			t.Fatal(err)
+		}
+
+		ttl, err := s.TTL(onlineID, offlineID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ttl[0] <= 0 || ttl[0] > testMemoryTimeoutDuration {
+			t.Fatalf("ttl of %s should be in (0, %s], but got: %s", onlineID, testMemoryTimeoutDuration, ttl[0])
+		}
+
+		if ttl[1] != 0 {
+			t.Fatalf("ttl of %s should be 0, but got: %s", offlineID, ttl[1])
+		}
+
+		// sleep until expiration
+		time.Sleep(testMemoryTimeoutDuration * 2)
+
+		if ttl, err = s.TTL(onlineID); err != nil || ttl[0] != 0 {
+			t.Fatalf("ttl of the expired %s should be 0, but got: %v %v", onlineID, ttl, err)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryOnlineTTL(t *testing.T) {
+	backend, err := NewMemory(testMemoryTimeoutDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mobileID, webID := <-nextID, <-nextID
+	s, err := New(backend, WithTTLPolicy(func(id, device string) time.Duration {
+		if id == mobileID || device == "phone" {
+			return testMemoryTimeoutDuration * 4
+		}
+
+		return 0
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.OnlineTTL(0, webID); err != ErrInvalidDuration {
+		t.Fatalf("err should be %s, but got: %v", ErrInvalidDuration, err)
+	}
+
+	if err := s.Online(mobileID, webID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.OnlineDevice(webID, "phone"); err != nil {
+		t.Fatal(err)
+	}
+
+	// sleep until the expiration of the default duration
+	time.Sleep(testMemoryTimeoutDuration * 2)
+
+	status, err := s.Status(mobileID, webID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, st := range status {
+		if st.Status != Online {
+			t.Fatalf("%s should be online with the duration of the policy, but got: %s", st.ID, st.Status)
+		}
+	}
+
+	// explicit durations override the policy
+	if err := s.SetStatusTTL(Away, testMemoryTimeoutDuration, mobileID); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(testMemoryTimeoutDuration * 2)
+
+	if status, err = s.Status(mobileID); err != nil || status[0].Status != Offline {
+		t.Fatalf("%s should be offline, but got: %v %v", mobileID, status, err)
+	}
+}
+
+func TestMemoryListOnline(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		ids := []string{"id-c", "id-a", "id-e", "id-b", "id-d"}
+		if err := s.Online(ids...); err != nil {
+			t.Fatal(err)
+		}
+
+		count, err := s.Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != len(ids) {
+			t.Fatalf("count should be %d, but got: %d", len(ids), count)
+		}
+
+		if _, _, err := s.ListOnline("", 0); err != ErrInvalidLimit {
+			t.Fatalf("err should be %s, but got: %v", ErrInvalidLimit, err)
+		}
+
+		var pages [][]string
+		for cursor := ""; ; {
+			page, next, err := s.ListOnline(cursor, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pages = append(pages, page)
+			if cursor = next; cursor == "" {
+				break
+			}
+		}
+
+		if fmt.Sprint(pages) != "[[id-a id-b] [id-c id-d] [id-e]]" {
+			t.Fatalf("ids should be listed in order, but got: %v", pages)
+		}
+
+		// sleep until expiration
+		time.Sleep(testMemoryTimeoutDuration * 2)
+
+		if count, err = s.Count(); err != nil || count != 0 {
+			t.Fatalf("count should be 0, but got: %d %v", count, err)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryStatusWithTimeout(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		id := <-nextID
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		// sleep until expiration
+		time.Sleep(testMemoryTimeoutDuration * 2)
+
+		status, err := s.Status(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status[0].Status != Offline {
+			t.Fatalf("%s should be %s, but it is %s", id, Offline, status[0].Status)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemorySubscriptions(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		ids := []string{<-nextID, <-nextID, <-nextID}
+		events := s.ListenStatusChanges()
+
+		if err := s.Online(ids...); err != nil {
+			t.Fatal(err)
+		}
+
+		// refreshing an online id should not generate an event
+		if err := s.Online(ids...); err != nil {
+			t.Fatal(err)
+		}
+
+		onlineCount := 0
+		offlineCount := 0
+		timeout := time.After(testMemoryTimeoutDuration * 5)
+		for onlineCount+offlineCount < len(ids)*2 {
+			select {
+			case event := <-events:
+				switch event.Status {
+				case Online:
+					onlineCount++
+				case Offline:
+					offlineCount++
+				}
+			case <-timeout:
+				t.Fatalf("timed out, online count: %d offline count: %d", onlineCount, offlineCount)
+			}
+		}
+
+		if onlineCount != len(ids) {
+			t.Fatalf("online count should be: %d, but it is: %d", len(ids), onlineCount)
+		}
+
+		if offlineCount != len(ids) {
+			t.Fatalf("offline count should be: %d, but it is: %d", len(ids), offlineCount)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryEventDetails(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		sub, err := s.Subscribe(WithBuffer(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id := <-nextID
+		before := time.Now()
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.SetStatus(Away, id); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Offline(id); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []Event{
+			{ID: id, Status: Online, Previous: Offline, Seq: 1},
+			{ID: id, Status: Away, Previous: Online, Seq: 2},
+			{ID: id, Status: Offline, Previous: Away, Seq: 3},
+			{ID: id, Status: Online, Previous: Offline, Seq: 4},
+			{ID: id, Status: Offline, Previous: Online, Seq: 5},
+		}
+
+		for i, e := range receiveAll(t, sub, len(expected)) {
+			if e.Time.Before(before) {
+				t.Fatalf("time of %v should not be before %s", e, before)
+			}
+
+			e.Time = time.Time{}
+			if e != expected[i] {
+				t.Fatalf("event should be %v, but got: %v", expected[i], e)
+			}
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryContext(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		ctx, cancel := context.WithCancel(context.Background())
+		events := s.ListenStatusChangesContext(ctx)
+
+		if err := s.OnlineContext(ctx, <-nextID); err != nil {
+			t.Fatal(err)
+		}
+
+		cancel()
+
+		if err := s.OnlineContext(ctx, <-nextID); err != context.Canceled {
+			t.Fatalf("err should be %s, but got: %v", context.Canceled, err)
+		}
+
+		// pending events may still be delivered before the channel is closed
+		timeout := time.After(testMemoryTimeoutDuration)
+		for {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					return
+				}
+			case <-timeout:
+				t.Fatal("events channel should be closed when the context is done")
+			}
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryClose(t *testing.T) {
+	backend, err := NewMemory(testMemoryTimeoutDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := backend.ListenStatusChanges()
+	if err := backend.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := <-events; ok {
+		t.Fatal("events channel should be closed")
+	}
+
+	if err := backend.Close(); err != ErrClosed {
+		t.Fatalf("err should be %s, but got: %v", ErrClosed, err)
+	}
+
+	if err := backend.Online(<-nextID); err != ErrClosed {
+		t.Fatalf("err should be %s, but got: %v", ErrClosed, err)
+	}
+}
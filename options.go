@@ -0,0 +1,190 @@
+package presence
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedisOption configures the Redis backend
+type RedisOption func(*redisConfig)
+
+// redisConfig holds the connection and behaviour settings of the Redis backend
+type redisConfig struct {
+	// password for AUTH, empty if the server does not require one
+	password string
+
+	// tlsConfig enables TLS if it is not nil
+	tlsConfig *tls.Config
+
+	// pool settings, see redigo Pool for their details
+	maxIdle     int
+	maxActive   int
+	idleTimeout time.Duration
+	wait        bool
+
+	// connection timeouts, zero means no timeout
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+
+	// prefix of the keys of the backend
+	prefix string
+
+	// streamMaxLen enables the stream if it is not 0
+	streamMaxLen int
+
+	// reconcile enables re-reading the statuses after reconnects
+	reconcile bool
+
+	// sortedSet enables the sorted set storage, expired ids are swept in
+	// every sweepInterval
+	sortedSet     bool
+	sweepInterval time.Duration
+}
+
+// defaultRedisConfig returns the config that is used if no options are given
+func defaultRedisConfig() *redisConfig {
+	return &redisConfig{
+		maxIdle:     3,
+		idleTimeout: time.Second * 240,
+		prefix:      Prefix,
+	}
+}
+
+// WithPassword sets the password that is sent with AUTH after connecting
+func WithPassword(password string) RedisOption {
+	return func(c *redisConfig) {
+		c.password = password
+	}
+}
+
+// WithTLS enables TLS with the given config
+func WithTLS(config *tls.Config) RedisOption {
+	return func(c *redisConfig) {
+		if config == nil {
+			config = &tls.Config{}
+		}
+
+		c.tlsConfig = config
+	}
+}
+
+// WithPool sets the max idle and max active connection counts of the pool. If
+// wait is true, operations wait for a free connection when the pool is at its
+// max active count, otherwise they fail
+func WithPool(maxIdle, maxActive int, wait bool) RedisOption {
+	return func(c *redisConfig) {
+		c.maxIdle = maxIdle
+		c.maxActive = maxActive
+		c.wait = wait
+	}
+}
+
+// WithIdleTimeout sets the duration after which idle connections are closed
+func WithIdleTimeout(d time.Duration) RedisOption {
+	return func(c *redisConfig) {
+		c.idleTimeout = d
+	}
+}
+
+// WithTimeouts sets the connect, read and write timeouts of the connections.
+// Subscriptions wait for messages without the read timeout
+func WithTimeouts(connect, read, write time.Duration) RedisOption {
+	return func(c *redisConfig) {
+		c.connectTimeout = connect
+		c.readTimeout = read
+		c.writeTimeout = write
+	}
+}
+
+// WithPrefix sets the prefix of the keys, backends with different prefixes
+// can share the same database. Every backend only reports the status changes
+// of the keys in its own namespace. The prefix should not be empty or contain
+// ':', and it should not end with "-devices", "-group", "-contacts" or
+// "-watchers", those are the names of the keys of the other prefixes
+func WithPrefix(prefix string) RedisOption {
+	return func(c *redisConfig) {
+		c.prefix = prefix
+	}
+}
+
+// WithStream enables appending the status transitions to a redis stream with
+// the given approximate max length. Unlike keyspace notifications, entries of
+// the stream are kept while consumers are away, and they can be consumed with
+// ListenStream
+func WithStream(maxLen int) RedisOption {
+	return func(c *redisConfig) {
+		c.streamMaxLen = maxLen
+	}
+}
+
+// WithReconcile enables re-reading the statuses of the ids after the
+// subscription of ListenStatusChanges is re-established. The last delivered
+// status of every non-offline id is kept, and an event is delivered for the
+// ones whose status changed while the subscription was down. Ids that became
+// online while the subscription was down can not be detected
+func WithReconcile() RedisOption {
+	return func(c *redisConfig) {
+		c.reconcile = true
+	}
+}
+
+// WithSortedSet stores the online ids in a sorted set scored by their
+// expiration time instead of a key per id. A sweeper removes the expired ids
+// in every given interval and publishes their Offline transitions itself, so
+// keyspace notifications are not needed and the Offline events are delayed at
+// most by the interval, rather than by the expiry cycle of redis
+func WithSortedSet(sweepInterval time.Duration) RedisOption {
+	return func(c *redisConfig) {
+		c.sortedSet = true
+		c.sweepInterval = sweepInterval
+	}
+}
+
+// parseRedisURL converts a redis:// or rediss:// url to the server address,
+// the db number and the options for the password and TLS
+func parseRedisURL(rawurl string) (string, int, []RedisOption, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	var opts []RedisOption
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		opts = append(opts, WithTLS(&tls.Config{ServerName: u.Hostname()}))
+	default:
+		return "", 0, nil, errors.New("invalid redis url scheme: " + u.Scheme)
+	}
+
+	host, port := u.Hostname(), u.Port()
+	if host == "" {
+		host = "localhost"
+	}
+
+	if port == "" {
+		port = "6379"
+	}
+
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			opts = append(opts, WithPassword(password))
+		}
+	}
+
+	db := 0
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		db, err = strconv.Atoi(path)
+		if err != nil {
+			return "", 0, nil, errors.New("invalid redis url database: " + path)
+		}
+	}
+
+	return net.JoinHostPort(host, port), db, opts, nil
+}
@@ -0,0 +1,217 @@
+package presence
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gredis "github.com/garyburd/redigo/redis"
+)
+
+func TestParseRedisURL(t *testing.T) {
+	server, db, opts, err := parseRedisURL("rediss://:secret@example.com:6380/10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server != "example.com:6380" {
+		t.Fatalf("server should be example.com:6380, but got: %s", server)
+	}
+
+	if db != 10 {
+		t.Fatalf("db should be 10, but got: %d", db)
+	}
+
+	conf := defaultRedisConfig()
+	for _, opt := range opts {
+		opt(conf)
+	}
+
+	if conf.password != "secret" {
+		t.Fatalf("password should be secret, but got: %s", conf.password)
+	}
+
+	if conf.tlsConfig == nil || conf.tlsConfig.ServerName != "example.com" {
+		t.Fatalf("tls should be enabled for example.com, but got: %v", conf.tlsConfig)
+	}
+}
+
+func TestParseRedisURLDefaults(t *testing.T) {
+	server, db, opts, err := parseRedisURL("redis://")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server != "localhost:6379" {
+		t.Fatalf("server should be localhost:6379, but got: %s", server)
+	}
+
+	if db != 0 {
+		t.Fatalf("db should be 0, but got: %d", db)
+	}
+
+	if len(opts) != 0 {
+		t.Fatalf("there should not be any options, but got: %d", len(opts))
+	}
+}
+
+func TestParseRedisURLInvalid(t *testing.T) {
+	for _, rawurl := range []string{"http://localhost", "redis://localhost/db"} {
+		if _, _, _, err := parseRedisURL(rawurl); err == nil {
+			t.Fatalf("%s should not be parsed", rawurl)
+		}
+	}
+}
+
+func TestPrefixes(t *testing.T) {
+	prefix := <-nextID
+	err := withConn(func(s *Session) {
+		backend := s.backend.(*Redis)
+		if key := backend.addPrefix("id"); key != prefix+":id" {
+			t.Fatalf("key should be %s:id, but got: %s", prefix, key)
+		}
+
+		id := <-nextID
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		// same id should not be online in the default namespace
+		err := withConn(func(other *Session) {
+			status, err := other.Status(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if status[0].Status != Offline {
+				t.Fatalf("%s should be %s in another namespace, but it is %s", id, Offline, status[0].Status)
+			}
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}, WithPrefix(prefix))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrefixInvalid(t *testing.T) {
+	for _, prefix := range []string{"", "presence:chat", "presence-devices", "chat-group"} {
+		if _, err := NewRedis("localhost:6379", 10, time.Second, WithPrefix(prefix)); err != ErrInvalidPrefix {
+			t.Fatalf("err should be %s for prefix %q, but got: %v", ErrInvalidPrefix, prefix, err)
+		}
+	}
+}
+
+func TestPrefixValid(t *testing.T) {
+	for _, prefix := range []string{"presence", "my-app", "devices", "chat-groups"} {
+		if !validPrefix(prefix) {
+			t.Fatalf("prefix %q should be valid", prefix)
+		}
+	}
+}
+
+func TestPrefixIDFromKey(t *testing.T) {
+	s := &Redis{prefix: "chat"}
+	if id, ok := s.idFromKey("chat:id:1"); !ok || id != "id:1" {
+		t.Fatalf("id should be id:1, but got: %q %t", id, ok)
+	}
+
+	// keys of the other namespaces and the other keys of the backend
+	for _, key := range []string{"chat:", "chat", "chatroom:id", "presence:id", "chat-last-seen", "chat-devices:id"} {
+		if id, ok := s.idFromKey(key); ok {
+			t.Fatalf("%s should not have an id, but got: %s", key, id)
+		}
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	s := &Redis{
+		prefix:               "chat",
+		statusPattern:        escapePattern("chat-status"),
+		becameOfflinePattern: "__keyevent@10__:expired",
+		errChan:              make(chan error, 1),
+	}
+
+	ms := int64(1500000000000)
+	tests := []struct {
+		message  gredis.PMessage
+		expected Event
+		ok       bool
+	}{
+		{
+			gredis.PMessage{Pattern: s.statusPattern, Data: []byte("AWAY 3 ONLINE 1500000000000 id 1")},
+			Event{ID: "id 1", Status: Away, Previous: Online, Time: msToTime(ms), Seq: 3},
+			true,
+		},
+		{gredis.PMessage{Pattern: s.statusPattern, Data: []byte("AWAY 3 ONLINE id")}, Event{}, false},
+		{gredis.PMessage{Pattern: s.statusPattern, Data: []byte("AWAY x ONLINE 1500000000000 id")}, Event{}, false},
+		{gredis.PMessage{Pattern: s.becameOfflinePattern, Data: []byte("other:id")}, Event{}, false},
+	}
+
+	for _, test := range tests {
+		e, ok := s.createEvent(context.Background(), test.message)
+		if e != test.expected || ok != test.ok {
+			t.Fatalf("event of %s should be %v %t, but got: %v %t", test.message.Data, test.expected, test.ok, e, ok)
+		}
+	}
+
+	if _, err := parseTransition("id", "AWAY 1 BUSYY 1500000000000"); err != ErrInvalidStatus {
+		t.Fatalf("err should be %s, but got: %v", ErrInvalidStatus, err)
+	}
+
+	if pattern := escapePattern("a*b?[c]"); pattern != `a\*b\?\[c\]` {
+		t.Fatalf("pattern should be escaped, but got: %s", pattern)
+	}
+}
+
+func TestPrefixForeignKeys(t *testing.T) {
+	prefix := <-nextID
+	err := withConn(func(s *Session) {
+		events := s.ListenStatusChanges()
+
+		// wait for the subscription
+		time.Sleep(time.Millisecond * 100)
+
+		err := withConn(func(other *Session) {
+			c := other.backend.(*Redis).pool.Get()
+			defer c.Close()
+
+			// keys of another application and another namespace
+			for _, key := range []string{"a", prefix + "room:" + <-nextID} {
+				if _, err := c.Do("SET", key, "value", "PX", 10); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := other.Online(<-nextID); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id := <-nextID
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case event := <-events:
+			if event.ID != id || event.Status != Online {
+				t.Fatalf("event should be {%s %s}, but got: %v", id, Online, event)
+			}
+		case <-time.After(testTimeoutDuration):
+			t.Fatal("timed out waiting for the event")
+		}
+	}, WithPrefix(prefix))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,6 +1,11 @@
 // Package presence provides an advanced presence system
 package presence
 
+import (
+	"context"
+	"time"
+)
+
 const (
 	// Unknown is for errored requests
 	Unknown Status = iota
@@ -10,12 +15,30 @@ const (
 
 	// Online is for displaying user as online in the system
 	Online
+
+	// Away is for displaying user as online but away from keyboard
+	Away
+
+	// Busy is for displaying user as online but busy
+	Busy
+
+	// DoNotDisturb is for displaying user as online but not willing to be
+	// disturbed
+	DoNotDisturb
+
+	// Invisible is for users who are online but want to be displayed as
+	// offline, it is up to the application to hide them
+	Invisible
 )
 
 const (
-	online  = "ONLINE"
-	offline = "OFFLINE"
-	unknown = "UNKNOWN"
+	online       = "ONLINE"
+	offline      = "OFFLINE"
+	unknown      = "UNKNOWN"
+	away         = "AWAY"
+	busy         = "BUSY"
+	doNotDisturb = "DO_NOT_DISTURB"
+	invisible    = "INVISIBLE"
 )
 
 // Status defines what is the current status of a user in presence system
@@ -28,21 +51,100 @@ func (s Status) String() string {
 		return offline
 	case Online:
 		return online
+	case Away:
+		return away
+	case Busy:
+		return busy
+	case DoNotDisturb:
+		return doNotDisturb
+	case Invisible:
+		return invisible
 	}
 
 	// if status is not set or not a known value
 	return unknown
 }
 
+// parseStatus converts the string representation of a status back to Status
+func parseStatus(s string) (Status, error) {
+	switch s {
+	case offline:
+		return Offline, nil
+	case online:
+		return Online, nil
+	case away:
+		return Away, nil
+	case busy:
+		return Busy, nil
+	case doNotDisturb:
+		return DoNotDisturb, nil
+	case invisible:
+		return Invisible, nil
+	}
+
+	return Unknown, ErrInvalidStatus
+}
+
+// isSettable reports whether the status can be set on an online id
+func (s Status) isSettable() bool {
+	return s >= Online && s <= Invisible
+}
+
 // Backend represents basic interface for all required backend operations for
 // presence package
 type Backend interface {
 	Online(...string) error
+	OnlineTTL(time.Duration, ...string) error
 	Offline(...string) error
+	OnlineDevice(id, device string) error
+	OnlineDeviceTTL(ttl time.Duration, id, device string) error
+	OfflineDevice(id, device string) error
+	SetStatus(Status, ...string) error
+	SetStatusTTL(Status, time.Duration, ...string) error
 	Status(...string) ([]Event, error)
+	Lookup(...string) ([]Result, error)
+	LastSeen(...string) ([]time.Time, error)
+	TTL(...string) ([]time.Duration, error)
+	Count() (int, error)
+	ListOnline(cursor string, limit int) ([]string, string, error)
+	Join(group string, ids ...string) error
+	Leave(group string, ids ...string) error
+	Members(group string) ([]string, error)
+	SubscribeGroup(group string, opts ...SubscribeOption) (*Subscription, error)
+	AddContacts(id string, contacts ...string) error
+	RemoveContacts(id string, contacts ...string) error
+	Contacts(id string) ([]string, error)
+	Watchers(id string) ([]string, error)
 	Close() error
 	Error() chan error
 	ListenStatusChanges() chan Event
+	Subscribe(...SubscribeOption) (*Subscription, error)
+
+	// context aware versions of the operations
+	OnlineContext(context.Context, ...string) error
+	OnlineTTLContext(context.Context, time.Duration, ...string) error
+	OfflineContext(context.Context, ...string) error
+	OnlineDeviceContext(ctx context.Context, id, device string) error
+	OnlineDeviceTTLContext(ctx context.Context, ttl time.Duration, id, device string) error
+	OfflineDeviceContext(ctx context.Context, id, device string) error
+	SetStatusContext(context.Context, Status, ...string) error
+	SetStatusTTLContext(context.Context, Status, time.Duration, ...string) error
+	StatusContext(context.Context, ...string) ([]Event, error)
+	LookupContext(context.Context, ...string) ([]Result, error)
+	LastSeenContext(context.Context, ...string) ([]time.Time, error)
+	TTLContext(context.Context, ...string) ([]time.Duration, error)
+	CountContext(context.Context) (int, error)
+	ListOnlineContext(ctx context.Context, cursor string, limit int) ([]string, string, error)
+	JoinContext(ctx context.Context, group string, ids ...string) error
+	LeaveContext(ctx context.Context, group string, ids ...string) error
+	MembersContext(ctx context.Context, group string) ([]string, error)
+	SubscribeGroupContext(ctx context.Context, group string, opts ...SubscribeOption) (*Subscription, error)
+	AddContactsContext(ctx context.Context, id string, contacts ...string) error
+	RemoveContactsContext(ctx context.Context, id string, contacts ...string) error
+	ContactsContext(ctx context.Context, id string) ([]string, error)
+	WatchersContext(ctx context.Context, id string) ([]string, error)
+	ListenStatusChangesContext(context.Context) chan Event
+	SubscribeContext(context.Context, ...SubscribeOption) (*Subscription, error)
 }
 
 // Event is the data type for occuring events in the system
@@ -52,23 +154,116 @@ type Event struct {
 
 	// Status holds the changing type of event
 	Status Status
+
+	// Previous is the status of the id before the transition
+	Previous Status
+
+	// Time is the time of the transition
+	Time time.Time
+
+	// Seq is the sequence number of the transition, it increases with every
+	// transition of the id
+	Seq int64
+}
+
+// Result is the detailed status of an id
+type Result struct {
+	// ID is the given key by the application
+	ID string
+
+	// Status is the current status of the id
+	Status Status
+
+	// TTL is the remaining time until the id becomes offline without a probe,
+	// zero for the offline ids
+	TTL time.Duration
+
+	// LastSeen is the last time the id is seen, zero if it is never seen
+	LastSeen time.Time
+
+	// Err is the error of the lookup of the id, the other fields except ID are
+	// not set if it is not nil
+	Err error
+}
+
+// TTLPolicy returns the inactive duration of the id, device is empty for the
+// calls without a device. Zero means the inactive duration of the backend
+type TTLPolicy func(id, device string) time.Duration
+
+// SessionOption configures a Session
+type SessionOption func(*Session)
+
+// WithTTLPolicy sets the policy that decides the inactive durations of the ids
+// that are set as online without an explicit duration, e.g. web clients that
+// probe often and push-only mobile clients that rarely check in can have
+// different durations
+func WithTTLPolicy(policy TTLPolicy) SessionOption {
+	return func(s *Session) {
+		s.policy = policy
+	}
 }
 
 // Session holds the backend and provides accessor methods for communication
 type Session struct {
 	// holds the interface
 	backend Backend
+
+	// watch dispatches the status changes to the watchers
+	watch *watchHub
+
+	// policy decides the inactive durations of the ids, nil if every id has
+	// the inactive duration of the backend
+	policy TTLPolicy
 }
 
 // New creates a session for any broker system that is architected to use,
 // communicate, forward events to the presence system
-func New(backend Backend) (*Session, error) {
-	return &Session{backend: backend}, nil
+func New(backend Backend, opts ...SessionOption) (*Session, error) {
+	s := &Session{backend: backend, watch: newWatchHub()}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s, nil
 }
 
-// Online sets given ids as online
+// Online sets given ids as online, see WithTTLPolicy for the inactive
+// durations of the ids
 func (s *Session) Online(ids ...string) error {
-	return s.backend.Online(ids...)
+	return s.OnlineContext(context.Background(), ids...)
+}
+
+// OnlineContext is the context aware version of Online
+func (s *Session) OnlineContext(ctx context.Context, ids ...string) error {
+	if s.policy == nil {
+		return s.backend.OnlineContext(ctx, ids...)
+	}
+
+	for _, group := range s.groupByTTL(ids) {
+		var err error
+		if group.ttl == 0 {
+			err = s.backend.OnlineContext(ctx, group.ids...)
+		} else {
+			err = s.backend.OnlineTTLContext(ctx, group.ttl, group.ids...)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OnlineTTL sets given ids as online with the given inactive duration instead
+// of the one of the backend, the policy is not consulted
+func (s *Session) OnlineTTL(ttl time.Duration, ids ...string) error {
+	return s.backend.OnlineTTL(ttl, ids...)
+}
+
+// OnlineTTLContext is the context aware version of OnlineTTL
+func (s *Session) OnlineTTLContext(ctx context.Context, ttl time.Duration, ids ...string) error {
+	return s.backend.OnlineTTLContext(ctx, ttl, ids...)
 }
 
 // Offline sets given ids as offline
@@ -76,11 +271,223 @@ func (s *Session) Offline(ids ...string) error {
 	return s.backend.Offline(ids...)
 }
 
+// OfflineContext is the context aware version of Offline
+func (s *Session) OfflineContext(ctx context.Context, ids ...string) error {
+	return s.backend.OfflineContext(ctx, ids...)
+}
+
+// OnlineDevice sets the given device of the id as online. The id is online as
+// long as any of its devices is online, and becomes offline when the last one
+// expires or set as offline
+func (s *Session) OnlineDevice(id, device string) error {
+	return s.OnlineDeviceContext(context.Background(), id, device)
+}
+
+// OnlineDeviceContext is the context aware version of OnlineDevice
+func (s *Session) OnlineDeviceContext(ctx context.Context, id, device string) error {
+	if ttl := s.ttl(id, device); ttl != 0 {
+		return s.backend.OnlineDeviceTTLContext(ctx, ttl, id, device)
+	}
+
+	return s.backend.OnlineDeviceContext(ctx, id, device)
+}
+
+// OnlineDeviceTTL sets the given device of the id as online with the given
+// inactive duration, the policy is not consulted
+func (s *Session) OnlineDeviceTTL(ttl time.Duration, id, device string) error {
+	return s.backend.OnlineDeviceTTL(ttl, id, device)
+}
+
+// OnlineDeviceTTLContext is the context aware version of OnlineDeviceTTL
+func (s *Session) OnlineDeviceTTLContext(ctx context.Context, ttl time.Duration, id, device string) error {
+	return s.backend.OnlineDeviceTTLContext(ctx, ttl, id, device)
+}
+
+// OfflineDevice sets the given device of the id as offline. Offline sets the id
+// as offline with all of its devices
+func (s *Session) OfflineDevice(id, device string) error {
+	return s.backend.OfflineDevice(id, device)
+}
+
+// OfflineDeviceContext is the context aware version of OfflineDevice
+func (s *Session) OfflineDeviceContext(ctx context.Context, id, device string) error {
+	return s.backend.OfflineDeviceContext(ctx, id, device)
+}
+
+// SetStatus sets the status of given ids, it also counts as a probe, so the
+// ids are refreshed or become online with the given status
+func (s *Session) SetStatus(status Status, ids ...string) error {
+	return s.SetStatusContext(context.Background(), status, ids...)
+}
+
+// SetStatusContext is the context aware version of SetStatus
+func (s *Session) SetStatusContext(ctx context.Context, status Status, ids ...string) error {
+	if s.policy == nil {
+		return s.backend.SetStatusContext(ctx, status, ids...)
+	}
+
+	for _, group := range s.groupByTTL(ids) {
+		var err error
+		if group.ttl == 0 {
+			err = s.backend.SetStatusContext(ctx, status, group.ids...)
+		} else {
+			err = s.backend.SetStatusTTLContext(ctx, status, group.ttl, group.ids...)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetStatusTTL sets the status of given ids with the given inactive duration,
+// the policy is not consulted
+func (s *Session) SetStatusTTL(status Status, ttl time.Duration, ids ...string) error {
+	return s.backend.SetStatusTTL(status, ttl, ids...)
+}
+
+// SetStatusTTLContext is the context aware version of SetStatusTTL
+func (s *Session) SetStatusTTLContext(ctx context.Context, status Status, ttl time.Duration, ids ...string) error {
+	return s.backend.SetStatusTTLContext(ctx, status, ttl, ids...)
+}
+
+// ttlGroup holds the ids that share the same inactive duration
+type ttlGroup struct {
+	ttl time.Duration
+	ids []string
+}
+
+// ttl returns the inactive duration of the id from the policy, zero for the
+// inactive duration of the backend
+func (s *Session) ttl(id, device string) time.Duration {
+	if s.policy == nil {
+		return 0
+	}
+
+	return s.policy(id, device)
+}
+
+// groupByTTL groups the ids by their inactive durations in the order of their
+// first id, so every group is still sent to the backend in a single call
+func (s *Session) groupByTTL(ids []string) []ttlGroup {
+	var groups []ttlGroup
+	index := make(map[time.Duration]int)
+	for _, id := range ids {
+		ttl := s.ttl(id, "")
+
+		i, ok := index[ttl]
+		if !ok {
+			i = len(groups)
+			index[ttl] = i
+			groups = append(groups, ttlGroup{ttl: ttl})
+		}
+
+		groups[i].ids = append(groups[i].ids, id)
+	}
+
+	return groups
+}
+
 // Status returns the current status of multiple keys from system
 func (s *Session) Status(ids ...string) ([]Event, error) {
 	return s.backend.Status(ids...)
 }
 
+// StatusContext is the context aware version of Status
+func (s *Session) StatusContext(ctx context.Context, ids ...string) ([]Event, error) {
+	return s.backend.StatusContext(ctx, ids...)
+}
+
+// Lookup returns the status, the remaining time to live and the last seen time
+// of the given ids. Results are in the order of the ids, lookups that fail for
+// an id have their Err set without failing the others
+func (s *Session) Lookup(ids ...string) ([]Result, error) {
+	return s.backend.Lookup(ids...)
+}
+
+// LookupContext is the context aware version of Lookup
+func (s *Session) LookupContext(ctx context.Context, ids ...string) ([]Result, error) {
+	return s.backend.LookupContext(ctx, ids...)
+}
+
+// LookupMap is the same as Lookup, but the results are keyed by their ids
+func (s *Session) LookupMap(ids ...string) (map[string]Result, error) {
+	return s.LookupMapContext(context.Background(), ids...)
+}
+
+// LookupMapContext is the context aware version of LookupMap
+func (s *Session) LookupMapContext(ctx context.Context, ids ...string) (map[string]Result, error) {
+	results, err := s.backend.LookupContext(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]Result, len(results))
+	for _, r := range results {
+		res[r.ID] = r
+	}
+
+	return res, nil
+}
+
+// LastSeen returns the last time the given ids are seen in the system. Online
+// ids are seen with their last probe, offline ones with their last probe
+// before they expired or when they are set as offline. Zero time is returned
+// for the ids that are never seen
+func (s *Session) LastSeen(ids ...string) ([]time.Time, error) {
+	return s.backend.LastSeen(ids...)
+}
+
+// LastSeenContext is the context aware version of LastSeen
+func (s *Session) LastSeenContext(ctx context.Context, ids ...string) ([]time.Time, error) {
+	return s.backend.LastSeenContext(ctx, ids...)
+}
+
+// TTL returns the remaining time until the given ids become offline without a
+// probe, zero for the offline ids. Heartbeats can be scheduled with it before
+// the ids expire
+func (s *Session) TTL(ids ...string) ([]time.Duration, error) {
+	return s.backend.TTL(ids...)
+}
+
+// TTLContext is the context aware version of TTL
+func (s *Session) TTLContext(ctx context.Context, ids ...string) ([]time.Duration, error) {
+	return s.backend.TTLContext(ctx, ids...)
+}
+
+// Count returns the number of the online ids. It walks over all of them, so it
+// is meant for dashboards and admin tools rather than the hot paths
+func (s *Session) Count() (int, error) {
+	return s.backend.Count()
+}
+
+// CountContext is the context aware version of Count
+func (s *Session) CountContext(ctx context.Context) (int, error) {
+	return s.backend.CountContext(ctx)
+}
+
+// ListOnline returns a page of the online ids starting from the given cursor
+// and the cursor of the next page. Listing starts with an empty cursor and
+// ends when the next cursor is empty
+//
+//	for cursor := ""; ; {
+//		ids, next, err := s.ListOnline(cursor, 100)
+//		...
+//		if cursor = next; cursor == "" {
+//			break
+//		}
+//	}
+func (s *Session) ListOnline(cursor string, limit int) ([]string, string, error) {
+	return s.backend.ListOnline(cursor, limit)
+}
+
+// ListOnlineContext is the context aware version of ListOnline
+func (s *Session) ListOnlineContext(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	return s.backend.ListOnlineContext(ctx, cursor, limit)
+}
+
 // Close closes the backend connection gracefully
 func (s *Session) Close() error {
 	return s.backend.Close()
@@ -96,3 +503,22 @@ func (s *Session) Error() chan error {
 func (s *Session) ListenStatusChanges() chan Event {
 	return s.backend.ListenStatusChanges()
 }
+
+// ListenStatusChangesContext is the context aware version of
+// ListenStatusChanges, listening stops and the channel is closed when the
+// context is done
+func (s *Session) ListenStatusChangesContext(ctx context.Context) chan Event {
+	return s.backend.ListenStatusChangesContext(ctx)
+}
+
+// Subscribe creates an independent subscription to the status changes, any
+// number of subscriptions can be open at the same time
+func (s *Session) Subscribe(opts ...SubscribeOption) (*Subscription, error) {
+	return s.backend.Subscribe(opts...)
+}
+
+// SubscribeContext is the context aware version of Subscribe, the
+// subscription is closed when the context is done
+func (s *Session) SubscribeContext(ctx context.Context, opts ...SubscribeOption) (*Subscription, error) {
+	return s.backend.SubscribeContext(ctx, opts...)
+}
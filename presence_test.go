@@ -1,6 +1,10 @@
 package presence
 
-import "testing"
+import (
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestStringer(t *testing.T) {
 	e := &Event{}
@@ -17,4 +21,52 @@ func TestStringer(t *testing.T) {
 	if e.Status.String() != offline {
 		t.Errorf("status string should be %s for offline Event, got: %s ", offline, e.Status.String())
 	}
+
+	e.Status = DoNotDisturb
+	if e.Status.String() != doNotDisturb {
+		t.Errorf("status string should be %s for do not disturb Event, got: %s ", doNotDisturb, e.Status.String())
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	for _, status := range []Status{Offline, Online, Away, Busy, DoNotDisturb, Invisible} {
+		parsed, err := parseStatus(status.String())
+		if err != nil {
+			t.Fatalf("%s should be parsed, but got err: %s", status, err.Error())
+		}
+
+		if parsed != status {
+			t.Fatalf("parsed status should be %s, but got: %s", status, parsed)
+		}
+	}
+
+	if _, err := parseStatus(unknown); err != ErrInvalidStatus {
+		t.Fatalf("err should be %s for unknown status, but got: %v", ErrInvalidStatus, err)
+	}
+}
+
+func TestGroupByTTL(t *testing.T) {
+	s, err := New(nil, WithTTLPolicy(func(id, device string) time.Duration {
+		if strings.HasPrefix(id, "mobile") {
+			return time.Minute * 10
+		}
+
+		return 0
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups := s.groupByTTL([]string{"web1", "mobile1", "web2", "mobile2"})
+	if len(groups) != 2 {
+		t.Fatalf("there should be 2 groups, but got: %v", groups)
+	}
+
+	if groups[0].ttl != 0 || strings.Join(groups[0].ids, ",") != "web1,web2" {
+		t.Fatalf("first group should have the web ids with the default ttl, but got: %v", groups[0])
+	}
+
+	if groups[1].ttl != time.Minute*10 || strings.Join(groups[1].ids, ",") != "mobile1,mobile2" {
+		t.Fatalf("second group should have the mobile ids with 10m ttl, but got: %v", groups[1])
+	}
 }
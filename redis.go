@@ -1,40 +1,109 @@
 package presence
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	gredis "github.com/garyburd/redigo/redis"
-	"github.com/koding/redis"
 )
 
 var (
-	// Prefix for presence package
+	// Prefix for presence package, it is the default prefix of the backends.
+	// It is read only when a backend is created, changing it afterwards does
+	// not affect the existing backends. See WithPrefix for the valid prefixes.
+	//
+	// Deprecated: use WithPrefix to set the prefix of a backend
 	Prefix = "presence"
 
+	// ErrInvalidPrefix for stating the key prefix is not valid
+	ErrInvalidPrefix = errors.New("prefix should not be empty, contain ':' or end with a reserved key name")
+
 	// ErrInvalidID for stating the event id is not valid
 	ErrInvalidID = errors.New("invalid id")
 
 	// ErrInvalidStatus for stating the event status is not valid
 	ErrInvalidStatus = errors.New("invalid status")
+
+	// ErrReconnected for stating the subscription is dropped and established
+	// again, events may be missed in between
+	ErrReconnected = errors.New("subscription is reconnected")
+)
+
+const (
+	// minReconnectDelay is the first wait time before re-establishing a
+	// dropped subscription
+	minReconnectDelay = time.Millisecond * 100
+
+	// maxReconnectDelay is the max wait time between reconnect attempts
+	maxReconnectDelay = time.Second * 10
+
+	// countScanSize is the SCAN count hint while counting the online ids
+	countScanSize = 1000
+
+	// sweepBatchSize is the max number of the expired ids that one sweep
+	// script removes, so redis is not blocked by a large sweep
+	sweepBatchSize = 1000
 )
 
 // Redis holds the required connection data for redis
 type Redis struct {
-	// main redis connection
-	redis *redis.RedisSession
+	// pool of the redis connections
+	pool *gredis.Pool
+
+	// prefix of the keys
+	prefix string
 
-	// inactiveDuration specifies no-probe allowance time
+	// readTimeout of the connections, zero means no timeout
+	readTimeout time.Duration
+
+	// inactiveDuration specifies no-probe allowance time in milliseconds
 	inactiveDuration string
 
+	// lastSeenKey holds the hash of last seen times of the ids
+	lastSeenKey string
+
+	// streamKey holds the stream that status transitions are appended to
+	streamKey string
+
+	// stateKey holds the hash of the last transitions of the ids
+	stateKey string
+
+	// streamMaxLen is the approximate max length of the stream, stream is
+	// disabled if it is 0
+	streamMaxLen int
+
+	// forwarder holds the pubsub connection that appends expirations to the
+	// stream
+	forwarder *gredis.PubSubConn
+
 	// receiving offline events pattern
 	becameOfflinePattern string
 
-	// receiving online events pattern
-	becameOnlinePattern string
+	// statusChannel is the channel that the scripts publish the online and
+	// status transitions to, statusPattern matches only that channel
+	statusChannel string
+	statusPattern string
+
+	// keyPattern matches the keys of the ids
+	keyPattern string
+
+	// sortedSet enables the sorted set storage, onlineKey holds the sorted set
+	// of the online ids scored by their expiration time and statusesKey holds
+	// the hash of their statuses. Expired ids are swept in every sweepInterval
+	sortedSet     bool
+	onlineKey     string
+	statusesKey   string
+	sweepInterval time.Duration
+
+	// groupPattern matches the channels of the groups, groups holds the
+	// members of the subscribed groups
+	groupPattern string
+	groups       map[string]*groupMembers
 
 	// errChan pipe all errors  the this channel
 	errChan chan error
@@ -42,11 +111,21 @@ type Redis struct {
 	// closed holds the status of connection
 	closed bool
 
+	// done is closed when the connection is closed
+	done chan struct{}
+
 	//psc holds the pubsub channel if opened
 	psc *gredis.PubSubConn
 
-	// holds event channel
-	events chan Event
+	// ready is closed when psc is subscribed to all of the patterns
+	ready chan struct{}
+
+	// hub broadcasts the events of psc to the subscriptions
+	hub *hub
+
+	// known holds the last delivered statuses of the non-offline ids, it is
+	// only set if reconciling is enabled
+	known map[string]Status
 
 	// lock for Redis struct
 	mu sync.Mutex
@@ -57,285 +136,1605 @@ func NewRedis(
 	server string, // connection string
 	db int, // redis db number
 	inactiveDuration time.Duration, // timeout duration
+	opts ...RedisOption, // connection and behaviour options
 ) (Backend, error) {
 
-	// create the redis connection
-	redis, err := redis.NewRedisSession(&redis.RedisConf{
-		Server: server,
-		DB:     db,
-	})
+	conf := defaultRedisConfig()
+	for _, opt := range opts {
+		opt(conf)
+	}
+
+	if conf.streamMaxLen < 0 {
+		return nil, errors.New("stream max length should not be negative")
+	}
+
+	if conf.sortedSet && conf.sweepInterval <= 0 {
+		return nil, errors.New("sweep interval should be positive")
+	}
+
+	// keys are expired in milliseconds, anything else would be truncated
+	if !validDuration(inactiveDuration) {
+		return nil, ErrInvalidDuration
+	}
+
+	if !validPrefix(conf.prefix) {
+		return nil, ErrInvalidPrefix
+	}
+
+	// create the redis connection pool
+	pool := newPool(server, db, conf)
+
+	// check the connection before handing over the backend
+	c := pool.Get()
+	_, err := c.Do("PING")
+	c.Close()
 	if err != nil {
+		pool.Close()
 		return nil, err
 	}
 
-	// for prefix for redis backend
-	redis.SetPrefix(Prefix)
-
-	return &Redis{
-		redis:                redis,
+	s := &Redis{
+		pool:                 pool,
+		prefix:               conf.prefix,
+		readTimeout:          conf.readTimeout,
 		becameOfflinePattern: fmt.Sprintf("__keyevent@%d__:expired", db),
-		becameOnlinePattern:  fmt.Sprintf("__keyevent@%d__:set", db),
-		inactiveDuration:     strconv.Itoa(int(inactiveDuration.Seconds())),
+		statusChannel:        conf.prefix + "-status",
+		statusPattern:        escapePattern(conf.prefix + "-status"),
+		keyPattern:           escapePattern(conf.prefix+":") + "*",
+		groupPattern:         escapePattern(conf.prefix+"-group:") + "*",
+		groups:               make(map[string]*groupMembers),
+		inactiveDuration:     durationToMs(inactiveDuration),
+		lastSeenKey:          conf.prefix + "-last-seen",
+		streamKey:            conf.prefix + "-events",
+		stateKey:             conf.prefix + "-state",
+		streamMaxLen:         conf.streamMaxLen,
+		sortedSet:            conf.sortedSet,
+		onlineKey:            conf.prefix + "-online",
+		statusesKey:          conf.prefix + "-statuses",
+		sweepInterval:        conf.sweepInterval,
 		errChan:              make(chan error, 1),
-	}, nil
+		done:                 make(chan struct{}),
+		hub:                  newHub(),
+	}
+
+	if conf.reconcile {
+		s.known = make(map[string]Status)
+	}
+
+	if s.sortedSet {
+		go s.sweep()
+	}
+
+	return s, nil
+}
+
+// NewRedisURL creates a Redis presence system from a redis:// or rediss://
+// url, e.g. redis://:password@localhost:6379/10. Options given explicitly
+// override the ones in the url
+func NewRedisURL(
+	rawurl string, // redis url
+	inactiveDuration time.Duration, // timeout duration
+	opts ...RedisOption, // connection and behaviour options
+) (Backend, error) {
+	server, db, urlOpts, err := parseRedisURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRedis(server, db, inactiveDuration, append(urlOpts, opts...)...)
+}
+
+// newPool creates the connection pool with the given config
+func newPool(server string, db int, conf *redisConfig) *gredis.Pool {
+	dialOpts := []gredis.DialOption{
+		gredis.DialDatabase(db),
+		gredis.DialConnectTimeout(conf.connectTimeout),
+		gredis.DialReadTimeout(conf.readTimeout),
+		gredis.DialWriteTimeout(conf.writeTimeout),
+	}
+
+	if conf.password != "" {
+		dialOpts = append(dialOpts, gredis.DialPassword(conf.password))
+	}
+
+	if conf.tlsConfig != nil {
+		dialOpts = append(dialOpts,
+			gredis.DialUseTLS(true),
+			gredis.DialTLSConfig(conf.tlsConfig),
+		)
+	}
+
+	return &gredis.Pool{
+		MaxIdle:     conf.maxIdle,
+		MaxActive:   conf.maxActive,
+		IdleTimeout: conf.idleTimeout,
+		Wait:        conf.wait,
+		Dial: func() (gredis.Conn, error) {
+			return gredis.Dial("tcp", server, dialOpts...)
+		},
+	}
 }
 
 // Online resets the expiration time for any given key. If key doesnt exists, it
 // means key (user) become online and should be set as online. Whenever
 // application gets any probe from a client should call this function. This
 // method performs way better when there is a throttling mechanism implemented
-// on top of it, please refer to benchmarks
+// on top of it, see Batcher and please refer to benchmarks
 func (s *Redis) Online(ids ...string) error {
-	// try to send expire command in a batch request. `Expire` command will
-	// reply with integer reply - 0 or 1 for a given key -
-	// http://redis.io/topics/protocol#integer-reply. If the response is 0 that
-	// means the key doesnt exist in our system. You can read more about redis
-	// `Exist` command here http://redis.io/commands/exists
-	existance, err := s.multiExpire(ids, s.inactiveDuration)
-	if err == nil {
-		return s.multiSetIfRequired(ids, existance, Error{})
-	}
-
-	// if err is not a multi err, return it
-	e, ok := err.(Error)
-	if !ok {
+	return s.OnlineContext(context.Background(), ids...)
+}
+
+// OnlineContext is the context aware version of Online
+func (s *Redis) OnlineContext(ctx context.Context, ids ...string) error {
+	_, err := s.online(ctx, ids, s.inactiveDuration)
+	return err
+}
+
+// OnlineTTL is the same as Online, but the ids expire after the given duration
+// instead of the inactive duration of the backend. Redis expires the keys in
+// milliseconds, so the duration should be a positive number of them
+func (s *Redis) OnlineTTL(ttl time.Duration, ids ...string) error {
+	return s.OnlineTTLContext(context.Background(), ttl, ids...)
+}
+
+// OnlineTTLContext is the context aware version of OnlineTTL
+func (s *Redis) OnlineTTLContext(ctx context.Context, ttl time.Duration, ids ...string) error {
+	if !validDuration(ttl) {
+		return ErrInvalidDuration
+	}
+
+	_, err := s.online(ctx, ids, durationToMs(ttl))
+	return err
+}
+
+// Offline sets given ids as offline with all of their devices and records the
+// current time as their last seen time. Offline transitions of the ids that
+// were online are published like the expired ones
+func (s *Redis) Offline(ids ...string) error {
+	return s.OfflineContext(context.Background(), ids...)
+}
+
+// OfflineContext is the context aware version of Offline
+func (s *Redis) OfflineContext(ctx context.Context, ids ...string) error {
+	if err := s.markOffline(ctx, ids, time.Now()); err != nil {
 		return err
 	}
 
-	// we have a multierr here, so process following operations with that info
-	if err := s.multiSetIfRequired(ids, existance, e); err != nil {
+	if s.sortedSet {
+		return s.zsetOffline(ctx, ids)
+	}
+
+	const zeroTimeString = "0"
+	existance, err := s.multiExpire(ctx, ids, zeroTimeString)
+	if err != nil {
 		return err
 	}
 
-	return e
+	// only the ids that were online are transitioned to offline
+	var removed []string
+	for i, exists := range existance {
+		if exists == 1 {
+			removed = append(removed, ids[i])
+		}
+	}
+
+	_, err = s.recordOffline(ctx, removed, true)
+	return err
 }
 
-// Offline sets given ids as offline
-func (s *Redis) Offline(ids ...string) error {
-	const zeroTimeString = "0"
-	_, err := s.multiExpire(ids, zeroTimeString)
+// OnlineDevice resets the expiration time of the given device of the id. The id
+// stays online as long as any of its devices is online, so its expiration time
+// is set to the latest expiration time of its devices
+func (s *Redis) OnlineDevice(id, device string) error {
+	return s.OnlineDeviceContext(context.Background(), id, device)
+}
+
+// OnlineDeviceContext is the context aware version of OnlineDevice
+func (s *Redis) OnlineDeviceContext(ctx context.Context, id, device string) error {
+	return s.onlineDevice(ctx, id, device, s.inactiveDuration)
+}
+
+// OnlineDeviceTTL is the same as OnlineDevice, but the device expires after the
+// given duration instead of the inactive duration of the backend
+func (s *Redis) OnlineDeviceTTL(ttl time.Duration, id, device string) error {
+	return s.OnlineDeviceTTLContext(context.Background(), ttl, id, device)
+}
+
+// OnlineDeviceTTLContext is the context aware version of OnlineDeviceTTL
+func (s *Redis) OnlineDeviceTTLContext(ctx context.Context, ttl time.Duration, id, device string) error {
+	if !validDuration(ttl) {
+		return ErrInvalidDuration
+	}
+
+	return s.onlineDevice(ctx, id, device, durationToMs(ttl))
+}
+
+// onlineDevice runs the online device script with the given inactive duration
+func (s *Redis) onlineDevice(ctx context.Context, id, device, duration string) error {
+	// get one connection from pool
+	c, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	// close connection
+	defer c.Close()
+
+	if s.sortedSet {
+		args := s.zsetScriptArgs([]string{s.devicesKey(id)}, []string{id},
+			duration, Online.String(), device,
+		)
+
+		_, err = zsetOnlineDeviceScript.Do(c, args...)
+		return err
+	}
+
+	args := s.scriptArgs(
+		[]string{s.addPrefix(id), s.devicesKey(id)},
+		duration, Online.String(), id, device,
+	)
+
+	_, err = onlineDeviceScript.Do(c, args...)
 	return err
 }
 
-// Status returns the current status of multiple keys from system
-func (s *Redis) Status(ids ...string) ([]Event, error) {
+// OfflineDevice sets the given device of the id as offline. The id becomes
+// offline only if it has no other online devices
+func (s *Redis) OfflineDevice(id, device string) error {
+	return s.OfflineDeviceContext(context.Background(), id, device)
+}
+
+// OfflineDeviceContext is the context aware version of OfflineDevice
+func (s *Redis) OfflineDeviceContext(ctx context.Context, id, device string) error {
 	// get one connection from pool
-	c := s.redis.Pool().Get()
+	c, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
 	// close connection
 	defer c.Close()
 
-	// init multi command
-	c.Send("MULTI")
+	if s.sortedSet {
+		args := s.zsetScriptArgs([]string{s.devicesKey(id)}, []string{id}, device)
 
-	// send exists command for all members
-	for _, id := range ids {
-		c.Send("EXISTS", s.redis.AddPrefix(id))
+		_, err = zsetOfflineDeviceScript.Do(c, args...)
+		return err
 	}
 
-	// execute command
-	r, err := c.Do("EXEC")
+	args := s.scriptArgs(
+		[]string{s.addPrefix(id), s.devicesKey(id)},
+		id, device,
+	)
+
+	_, err = offlineDeviceScript.Do(c, args...)
+	return err
+}
+
+// LastSeen returns the last time the given ids sent a probe or set as offline.
+// Zero time is returned for the ids that are never seen
+func (s *Redis) LastSeen(ids ...string) ([]time.Time, error) {
+	return s.LastSeenContext(context.Background(), ids...)
+}
+
+// LastSeenContext is the context aware version of LastSeen
+func (s *Redis) LastSeenContext(ctx context.Context, ids ...string) ([]time.Time, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// get one connection from pool
+	c, err := s.conn(ctx)
 	if err != nil {
 		return nil, err
 	}
+	// close connection
+	defer c.Close()
+
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, s.lastSeenKey)
+	for _, id := range ids {
+		args = append(args, id)
+	}
 
-	values, err := s.redis.Values(r)
+	values, err := gredis.Values(c.Do("HMGET", args...))
 	if err != nil {
 		return nil, err
 	}
 
 	e := Error{}
-	res := make([]Event, len(values))
+	res := make([]time.Time, len(values))
 	for i, value := range values {
-		status, err := s.redis.Int(value)
+		if value == nil {
+			continue
+		}
+
+		ms, err := gredis.Int64(value, nil)
 		if err != nil {
 			e.Append(ids[i], err)
 			continue
 		}
 
-		res[i] = Event{
-			ID: ids[i],
-			// cast redis response to Status
-			Status: redisResToStatus[status],
-		}
+		res[i] = msToTime(ms)
 	}
 
 	if e.Len() > 0 {
-		// generally returning a meaningful data along with an error is not a
-		// good idea, but here, most of the calls may success, we should not
-		// stop the execution on first error
 		return res, e
 	}
 
 	return res, nil
 }
 
-// Error returns error if it happens while listening  to status changes
-func (s *Redis) Error() chan error {
-	return s.errChan
-}
-
-// Close closes the redis connection gracefully
-func (s *Redis) Close() error {
-	return s.close()
+// TTL returns the remaining time until the given ids expire, zero for the
+// offline ids. PTTL commands are pipelined, so the ids are read in one round
+// trip without a transaction
+func (s *Redis) TTL(ids ...string) ([]time.Duration, error) {
+	return s.TTLContext(context.Background(), ids...)
 }
 
-// ListenStatusChanges subscribes with a pattern to the redis and
-// gets online and offline status changes from it
-func (s *Redis) ListenStatusChanges() chan Event {
-	s.psc = s.redis.CreatePubSubConn()
-	s.psc.PSubscribe(s.becameOnlinePattern, s.becameOfflinePattern)
-
-	s.events = make(chan Event)
-	go s.listenEvents()
-	return s.events
-}
+// TTLContext is the context aware version of TTL
+func (s *Redis) TTLContext(ctx context.Context, ids ...string) ([]time.Duration, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
 
-var redisResToStatus = map[int]Status{
-	// redis response for exists command is 0 when the id is not in the system
-	0: Offline,
+	if s.sortedSet {
+		return s.zsetTTL(ctx, ids)
+	}
 
-	// redis response for exists command is 1 when the id is in the system
-	1: Online,
-}
+	// get one connection from pool
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// close connection
+	defer c.Close()
 
-func (s *Redis) close() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	for _, id := range ids {
+		if err := c.Send("PTTL", s.addPrefix(id)); err != nil {
+			return nil, err
+		}
+	}
 
-	if s.closed {
-		return errors.New("closing of already closed connection")
+	if err := c.Flush(); err != nil {
+		return nil, err
 	}
 
-	s.closed = true
+	e := Error{}
+	res := make([]time.Duration, len(ids))
+	for i, id := range ids {
+		ms, err := gredis.Int64(c.Receive())
+		if err != nil {
+			e.Append(id, err)
+			continue
+		}
 
-	if s.events != nil {
-		close(s.events)
+		// negative replies are for the missing keys and the keys without expiry
+		if ms > 0 {
+			res[i] = time.Duration(ms) * time.Millisecond
+		}
 	}
 
-	if s.psc != nil {
-		s.psc.PUnsubscribe()
+	if e.Len() > 0 {
+		return res, e
 	}
 
-	return s.redis.Close()
+	return res, nil
 }
 
-// createEvent Creates the event with the required properties
-func (s *Redis) listenEvents() {
-	for {
-		s.mu.Lock()
-		if s.closed {
-			s.mu.Unlock()
-			return
-		}
-		s.mu.Unlock()
-
-		switch n := s.psc.Receive().(type) {
-		case gredis.PMessage:
-			s.events <- s.createEvent(n)
-		case error:
-			s.errChan <- n
-			return
-		}
-	}
+// Count returns the number of the online ids. Keys of the namespace are walked
+// with SCAN, so redis is not blocked, but it takes as long as listing all of
+// them
+func (s *Redis) Count() (int, error) {
+	return s.CountContext(context.Background())
 }
 
-// createEvent Creates the event with the required properties
-func (s *Redis) createEvent(n gredis.PMessage) Event {
-	e := Event{}
+// CountContext is the context aware version of Count
+func (s *Redis) CountContext(ctx context.Context) (int, error) {
+	// get one connection from pool
+	c, err := s.conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// close connection
+	defer c.Close()
 
-	// if incoming data len is smaller than our prefix, do not process the event
-	if len(n.Data) < len(Prefix) {
-		s.errChan <- ErrInvalidID
-		return e
+	// sorted set is counted in one call, expired ids that are not swept yet
+	// are excluded by their scores
+	if s.sortedSet {
+		return gredis.Int(c.Do("ZCOUNT", s.onlineKey, "("+strconv.FormatInt(timeToMs(time.Now()), 10), "+inf"))
 	}
 
-	e.ID = string(n.Data[len(Prefix)+1:])
+	// SCAN may return a key more than once
+	seen := make(map[string]struct{})
+	cursor := "0"
+	for {
+		var ids []string
+		ids, cursor, err = s.scan(c, cursor, countScanSize)
+		if err != nil {
+			return 0, err
+		}
 
-	switch n.Pattern {
-	case s.becameOfflinePattern:
-		e.Status = Offline
-	case s.becameOnlinePattern:
-		e.Status = Online
-	default:
-		s.errChan <- ErrInvalidStatus
+		for _, id := range ids {
+			seen[id] = struct{}{}
+		}
+
+		if cursor == "0" {
+			return len(seen), nil
+		}
 	}
+}
 
-	return e
+// ListOnline returns a page of the online ids starting from the given cursor
+// and the cursor of the next page, empty if there are no more ids. Keys of the
+// namespace are walked with SCAN, so the limit is only a hint, a page may have
+// a few more ids than it, and an id may be listed more than once
+func (s *Redis) ListOnline(cursor string, limit int) ([]string, string, error) {
+	return s.ListOnlineContext(context.Background(), cursor, limit)
 }
 
-// multiSetIfRequired accepts a set of ids and their existance status
-func (s *Redis) multiSetIfRequired(ids []string, existance []int, e Error) error {
-	// redis ensures that all the responses in a transaction will be in the same
-	// order with the requests. So we can safely assume that our keys and their
-	// responses are in the same order. For more info
-	// http://redis.io/topics/transactions
-	if len(ids) != len(existance) {
-		return fmt.Errorf(
-			"length is not same Ids: %d Existance: %d",
-			len(ids),
-			len(existance),
-		)
+// ListOnlineContext is the context aware version of ListOnline
+func (s *Redis) ListOnlineContext(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	if limit <= 0 {
+		return nil, "", ErrInvalidLimit
+	}
+
+	if cursor == "" {
+		cursor = "0"
 	}
 
 	// get one connection from pool
-	c := s.redis.Pool().Get()
-	// do not forget to close the connection
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	// close connection
 	defer c.Close()
 
-	// item count for non-existent members
-	notExistsCount := 0
-
-	// traverse over all the given keys and any key is not exists in db, set
-	// them in a multi/exec request
-	for i, exists := range existance {
-		// `0` means, member does not exists in presence system, no need to set
-		// `an expire on that key
-		if exists != 0 {
-			continue
+	var res []string
+	for {
+		var ids []string
+		ids, cursor, err = s.scan(c, cursor, limit)
+		if err != nil {
+			return nil, "", err
 		}
 
-		// if we got any error for the current id before, do not process it
-		if e.Has(ids[i]) {
-			continue
+		res = append(res, ids...)
+
+		if cursor == "0" {
+			return res, "", nil
 		}
 
-		// init multi command lazily
-		if notExistsCount == 0 {
-			if err := c.Send("MULTI"); err != nil {
-				return err
-			}
+		// SCAN may return no keys before the end of the iteration
+		if len(res) >= limit {
+			return res, cursor, nil
 		}
+	}
+}
 
-		notExistsCount++
+// scan runs one SCAN iteration over the keys of the namespace and returns the
+// ids of them with the next cursor, "0" if the iteration is done
+func (s *Redis) scan(c gredis.Conn, cursor string, count int) ([]string, string, error) {
+	if s.sortedSet {
+		return s.zsetScan(c, cursor, count)
+	}
 
-		// if we reach to that point, set the new key into system
-		err := c.Send("SETEX", s.redis.AddPrefix(ids[i]), s.inactiveDuration, ids[i])
-		if err != nil {
-			e.Append(ids[i], err)
-		}
+	values, err := gredis.Values(c.Do("SCAN", cursor, "MATCH", s.keyPattern, "COUNT", count))
+	if err != nil {
+		return nil, "", err
 	}
 
-	// execute multi command if only we flushed some to connection
-	if notExistsCount != 0 {
-		// ignore values
-		if _, err := c.Do("EXEC"); err != nil {
-			return err
+	var keys []string
+	if _, err := gredis.Scan(values, &cursor, &keys); err != nil {
+		return nil, "", err
+	}
+
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if id, ok := s.idFromKey(key); ok {
+			ids = append(ids, id)
 		}
 	}
 
-	// if we have any multierr, return it back
-	if e.Len() > 0 {
-		return e
+	return ids, cursor, nil
+}
+
+// SetStatus sets the status of given ids and resets their expiration time.
+// Keys are only overwritten when their status changes, so setting the same
+// status again works as a probe and does not generate an event
+func (s *Redis) SetStatus(status Status, ids ...string) error {
+	return s.SetStatusContext(context.Background(), status, ids...)
+}
+
+// SetStatusContext is the context aware version of SetStatus
+func (s *Redis) SetStatusContext(ctx context.Context, status Status, ids ...string) error {
+	return s.setStatus(ctx, status, ids, s.inactiveDuration)
+}
+
+// SetStatusTTL is the same as SetStatus, but the ids expire after the given
+// duration instead of the inactive duration of the backend
+func (s *Redis) SetStatusTTL(status Status, ttl time.Duration, ids ...string) error {
+	return s.SetStatusTTLContext(context.Background(), status, ttl, ids...)
+}
+
+// SetStatusTTLContext is the context aware version of SetStatusTTL
+func (s *Redis) SetStatusTTLContext(ctx context.Context, status Status, ttl time.Duration, ids ...string) error {
+	if !validDuration(ttl) {
+		return ErrInvalidDuration
 	}
 
-	return nil
+	return s.setStatus(ctx, status, ids, durationToMs(ttl))
 }
 
-// multiExpire if the system tries to update more than one key at a time
-// inorder to leverage rtt, send multi expire
-func (s *Redis) multiExpire(ids []string, duration string) ([]int, error) {
+// setStatus runs the set status script with the given inactive duration
+func (s *Redis) setStatus(ctx context.Context, status Status, ids []string, duration string) error {
+	if !status.isSettable() {
+		return ErrInvalidStatus
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
 	// get one connection from pool
-	c := s.redis.Pool().Get()
+	c, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	// close connection
+	defer c.Close()
+
+	if s.sortedSet {
+		_, err = zsetSetStatusScript.Do(c, s.zsetScriptArgs(nil, ids, duration, status.String())...)
+		return err
+	}
+
+	args := s.idScriptArgs(ids, duration, status.String())
+
+	_, err = setStatusScript.Do(c, args...)
+	return err
+}
+
+// Status returns the current status of multiple keys from system. Failed
+// lookups are returned with their ids and the Unknown status, their errors are
+// returned in an Error
+func (s *Redis) Status(ids ...string) ([]Event, error) {
+	return s.StatusContext(context.Background(), ids...)
+}
+
+// StatusContext is the context aware version of Status
+func (s *Redis) StatusContext(ctx context.Context, ids ...string) ([]Event, error) {
+	if s.sortedSet {
+		return s.zsetStatus(ctx, ids)
+	}
+
+	// get one connection from pool
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// close connection
+	defer c.Close()
+
+	// init multi command
+	c.Send("MULTI")
+
+	// send get command for all members, value of the key holds the status
+	for _, id := range ids {
+		c.Send("GET", s.addPrefix(id))
+	}
+
+	// execute command
+	r, err := c.Do("EXEC")
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := gredis.Values(r, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Error{}
+	res := make([]Event, len(values))
+	for i, value := range values {
+		status, err := redisResToStatus(value)
+		if err != nil {
+			e.Append(ids[i], err)
+			res[i] = Event{ID: ids[i]}
+			continue
+		}
+
+		res[i] = Event{
+			ID:     ids[i],
+			Status: status,
+		}
+	}
+
+	if e.Len() > 0 {
+		// generally returning a meaningful data along with an error is not a
+		// good idea, but here, most of the calls may success, we should not
+		// stop the execution on first error
+		return res, e
+	}
+
+	return res, nil
+}
+
+// Lookup returns the status, the remaining time to live and the last seen time
+// of the given ids in one round trip. Results whose lookup fails have their Err
+// set, the others are still returned
+func (s *Redis) Lookup(ids ...string) ([]Result, error) {
+	return s.LookupContext(context.Background(), ids...)
+}
+
+// LookupContext is the context aware version of Lookup
+func (s *Redis) LookupContext(ctx context.Context, ids ...string) ([]Result, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// get one connection from pool
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// close connection
+	defer c.Close()
+
+	// init multi command
+	c.Send("MULTI")
+
+	// value of the key holds the status, its ttl is the remaining time. Sorted
+	// set storage holds them in the statuses hash and the sorted set instead
+	now := timeToMs(time.Now())
+	for _, id := range ids {
+		if s.sortedSet {
+			c.Send("HGET", s.statusesKey, id)
+			c.Send("ZSCORE", s.onlineKey, id)
+			continue
+		}
+
+		key := s.addPrefix(id)
+		c.Send("GET", key)
+		c.Send("PTTL", key)
+	}
+
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, s.lastSeenKey)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	c.Send("HMGET", args...)
+
+	// execute command
+	values, err := gredis.Values(c.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+
+	// transaction replies with two values for every id and the last seen
+	// times
+	if len(values) != len(ids)*2+1 {
+		return nil, fmt.Errorf(
+			"length is not expected Ids: %d Replies: %d Expected: %d",
+			len(ids),
+			len(values),
+			len(ids)*2+1,
+		)
+	}
+
+	lastSeen, lastSeenErr := gredis.Values(values[len(values)-1], nil)
+
+	res := make([]Result, len(ids))
+	for i, id := range ids {
+		if s.sortedSet {
+			res[i] = zsetResult(id, values[i*2], values[i*2+1], now)
+		} else {
+			res[i] = lookupResult(id, values[i*2], values[i*2+1])
+		}
+
+		if res[i].Err != nil {
+			continue
+		}
+
+		if lastSeenErr != nil {
+			res[i] = Result{ID: id, Err: lastSeenErr}
+			continue
+		}
+
+		if lastSeen[i] == nil {
+			continue
+		}
+
+		ms, err := gredis.Int64(lastSeen[i], nil)
+		if err != nil {
+			res[i] = Result{ID: id, Err: err}
+			continue
+		}
+
+		res[i].LastSeen = msToTime(ms)
+	}
+
+	return res, nil
+}
+
+// lookupResult creates the result of an id from the replies of GET and PTTL
+func lookupResult(id string, value, pttl interface{}) Result {
+	status, err := redisResToStatus(value)
+	if err != nil {
+		return Result{ID: id, Err: err}
+	}
+
+	ms, err := gredis.Int64(pttl, nil)
+	if err != nil {
+		return Result{ID: id, Err: err}
+	}
+
+	res := Result{ID: id, Status: status}
+
+	// negative replies are for the missing keys and the keys without expiry
+	if status != Offline && ms > 0 {
+		res.TTL = time.Duration(ms) * time.Millisecond
+	}
+
+	return res
+}
+
+// Error returns error if it happens while listening  to status changes
+func (s *Redis) Error() chan error {
+	return s.errChan
+}
+
+// Close closes the redis connection gracefully
+func (s *Redis) Close() error {
+	return s.close()
+}
+
+// ListenStatusChanges subscribes with a pattern to the redis and
+// gets online and offline status changes from it. If the subscription drops,
+// it is re-established with backoff and ErrReconnected is sent to the error
+// channel, see WithReconcile for recovering the missed events. Every call
+// creates a new subscription on the same pubsub connection, see Subscribe
+func (s *Redis) ListenStatusChanges() chan Event {
+	return s.ListenStatusChangesContext(context.Background())
+}
+
+// ListenStatusChangesContext is the context aware version of
+// ListenStatusChanges. Listening stops and the channel is closed when the
+// context is done or the connection is closed
+func (s *Redis) ListenStatusChangesContext(ctx context.Context) chan Event {
+	sub, err := s.SubscribeContext(ctx)
+	if err != nil {
+		s.reportError(err)
+		return closedEvents()
+	}
+
+	return sub.Events()
+}
+
+// Subscribe creates an independent subscription to the status changes. The
+// pubsub connection is opened with the first subscription and it is shared
+// by all of them until the backend is closed
+func (s *Redis) Subscribe(opts ...SubscribeOption) (*Subscription, error) {
+	return s.SubscribeContext(context.Background(), opts...)
+}
+
+// SubscribeContext is the context aware version of Subscribe, the
+// subscription is closed when the context is done
+func (s *Redis) SubscribeContext(ctx context.Context, opts ...SubscribeOption) (*Subscription, error) {
+	sub, err := s.hub.subscribe(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.psc != nil {
+		return sub, nil
+	}
+
+	s.psc = s.pubSubConn()
+	s.ready = make(chan struct{})
+	if err := s.psc.PSubscribe(s.patterns()...); err != nil {
+		// listener will reconnect on the first receive
+		s.reportError(err)
+	}
+
+	go s.listenEvents()
+	return sub, nil
+}
+
+// redisResToStatus converts the stored value of a key to Status. Non existing
+// keys are offline, keys that are written before statuses were stored hold the
+// id itself, treat them as online
+func redisResToStatus(value interface{}) (Status, error) {
+	str, err := gredis.String(value, nil)
+	if err == gredis.ErrNil {
+		return Offline, nil
+	}
+
+	if err != nil {
+		return Unknown, err
+	}
+
+	status, err := parseStatus(str)
+	if err != nil {
+		return Online, nil
+	}
+
+	return status, nil
+}
+
+func (s *Redis) close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.New("closing of already closed connection")
+	}
+
+	s.closed = true
+	close(s.done)
+	psc, forwarder := s.psc, s.forwarder
+	s.mu.Unlock()
+
+	// close the subscriptions without the lock, closing a group subscription
+	// releases its group. The listener stops when its connection is closed
+	s.hub.close()
+	if psc != nil {
+		psc.Close()
+	}
+
+	if forwarder != nil {
+		forwarder.Close()
+	}
+
+	return s.pool.Close()
+}
+
+// listenEvents delivers the events to the subscriptions until the connection
+// is closed, and re-establishes the subscription if it drops
+func (s *Redis) listenEvents() {
+	ctx := context.Background()
+
+	for {
+		s.mu.Lock()
+		psc := s.psc
+		s.mu.Unlock()
+
+		switch n := psc.ReceiveWithTimeout(0).(type) {
+		case gredis.Subscription:
+			if n.Count == len(s.patterns()) {
+				s.mu.Lock()
+				closeReady(s.ready)
+				s.mu.Unlock()
+			}
+		case gredis.PMessage:
+			if n.Pattern == s.groupPattern {
+				s.changeMembership(n)
+				continue
+			}
+
+			e, ok := s.createEvent(ctx, n)
+			if !ok {
+				// key of another namespace or another application
+				continue
+			}
+
+			s.deliver(e)
+		case error:
+			if s.isClosed() {
+				return
+			}
+
+			s.reportError(n)
+
+			psc, ok := s.resubscribe(ctx, s.patterns()...)
+			if !ok {
+				return
+			}
+
+			s.mu.Lock()
+			if s.closed {
+				s.mu.Unlock()
+				psc.Close()
+				return
+			}
+
+			// dropped connection still holds its slot in the pool
+			s.psc.Close()
+			s.psc = psc
+
+			// nobody should wait for the dropped connection
+			closeReady(s.ready)
+			s.ready = make(chan struct{})
+			s.mu.Unlock()
+
+			s.reportError(ErrReconnected)
+			s.reconcile(ctx)
+			s.reloadGroups()
+		}
+	}
+}
+
+// deliver sends the event to the subscriptions and keeps track of its status
+// if reconciling is enabled
+func (s *Redis) deliver(e Event) {
+	s.mu.Lock()
+	if s.known != nil && e.ID != "" {
+		if e.Status == Offline {
+			delete(s.known, e.ID)
+		} else {
+			s.known[e.ID] = e.Status
+		}
+	}
+	s.mu.Unlock()
+
+	s.hub.publish(e)
+}
+
+// reconcile re-reads the statuses of the known ids and delivers the changed
+// ones
+func (s *Redis) reconcile(ctx context.Context) {
+	s.mu.Lock()
+	if len(s.known) == 0 {
+		s.mu.Unlock()
+		return
+	}
+
+	ids := make([]string, 0, len(s.known))
+	for id := range s.known {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+
+	res, err := s.StatusContext(ctx, ids...)
+	if err != nil {
+		s.reportError(err)
+	}
+
+	// failed lookups are reconciled on the next run
+	failed, _ := err.(Error)
+	for _, e := range res {
+		if failed.Has(e.ID) {
+			continue
+		}
+
+		s.mu.Lock()
+		status, ok := s.known[e.ID]
+		s.mu.Unlock()
+
+		if ok && status == e.Status {
+			continue
+		}
+
+		// missed transitions are not known, so reconciled events do not have
+		// a sequence number
+		e.Previous = status
+		e.Time = time.Now()
+		s.deliver(e)
+	}
+}
+
+// patterns returns the patterns that the pubsub connection subscribes to
+func (s *Redis) patterns() []interface{} {
+	// offline transitions of the sorted set storage are published by the
+	// sweeper, expirations are not needed
+	if s.sortedSet {
+		return []interface{}{s.statusPattern, s.groupPattern}
+	}
+
+	return []interface{}{s.statusPattern, s.becameOfflinePattern, s.groupPattern}
+}
+
+// closeReady closes the ready channel unless it is closed already, must be
+// called with the lock held
+func closeReady(ready chan struct{}) {
+	select {
+	case <-ready:
+	default:
+		close(ready)
+	}
+}
+
+// resubscribe creates a new pubsub connection for the given patterns, retrying
+// with backoff until it succeeds. Returns false if the context is done or the
+// connection is closed meanwhile
+func (s *Redis) resubscribe(ctx context.Context, patterns ...interface{}) (*gredis.PubSubConn, bool) {
+	delay := minReconnectDelay
+	for {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, false
+		case <-s.done:
+			return nil, false
+		}
+
+		psc := s.pubSubConn()
+		err := psc.PSubscribe(patterns...)
+		if err == nil {
+			return psc, true
+		}
+
+		psc.Close()
+		s.reportError(err)
+
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// createEvent Creates the event with the required properties. Expirations are
+// notified for every key of the db, false is returned if the key does not
+// belong to the backend. Online and status transitions are published by the
+// scripts of the backend, refreshes and the other keys never generate them
+func (s *Redis) createEvent(ctx context.Context, n gredis.PMessage) (Event, bool) {
+	switch n.Pattern {
+	case s.becameOfflinePattern:
+		id, ok := s.idFromKey(string(n.Data))
+		if !ok {
+			return Event{}, false
+		}
+
+		events, err := s.recordOffline(ctx, []string{id}, false)
+		if err != nil {
+			s.reportError(err)
+			return Event{ID: id, Status: Offline, Time: time.Now()}, true
+		}
+
+		// id is online again, its offline transition is recorded by the script
+		// that created it and it is followed by its online transition
+		if events[0].ID == "" {
+			return Event{}, false
+		}
+
+		return events[0], true
+	case s.statusPattern:
+		// message is the state and the id separated with a space
+		fields := strings.SplitN(string(n.Data), " ", 5)
+		if len(fields) != 5 {
+			s.reportError(ErrInvalidStatus)
+			return Event{}, false
+		}
+
+		e, err := parseTransition(fields[4], strings.Join(fields[:4], " "))
+		if err != nil {
+			s.reportError(err)
+			return Event{}, false
+		}
+
+		return e, true
+	}
+
+	s.reportError(ErrInvalidStatus)
+	return Event{}, false
+}
+
+// parseTransition converts the state of an id, "STATUS SEQ PREVIOUS TIME", to
+// an Event
+func parseTransition(id, state string) (Event, error) {
+	fields := strings.Split(state, " ")
+	if len(fields) != 4 {
+		return Event{}, ErrInvalidStatus
+	}
+
+	status, err := parseStatus(fields[0])
+	if err != nil {
+		return Event{}, err
+	}
+
+	seq, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return Event{}, err
+	}
+
+	previous, err := parseStatus(fields[2])
+	if err != nil {
+		return Event{}, err
+	}
+
+	ms, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return Event{}, err
+	}
+
+	return Event{
+		ID:       id,
+		Status:   status,
+		Previous: previous,
+		Time:     msToTime(ms),
+		Seq:      seq,
+	}, nil
+}
+
+// recordOffline records the Offline transitions of the given ids, ids that are
+// online again are skipped. Transitions are published if publish is true,
+// expirations are delivered by every instance that receives them instead.
+// Returns the transitions of the offline ids, the skipped ones are left empty
+func (s *Redis) recordOffline(ctx context.Context, ids []string, publish bool) ([]Event, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// get one connection from pool
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// close connection
+	defer c.Close()
+
+	states, err := gredis.Values(offlineScript.Do(c, s.idScriptArgs(ids, publish)...))
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]Event, len(ids))
+	for i, state := range states {
+		if state == nil {
+			continue
+		}
+
+		str, err := gredis.String(state, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if events[i], err = parseTransition(ids[i], str); err != nil {
+			return nil, err
+		}
+	}
+
+	return events, nil
+}
+
+// escapePattern escapes the glob characters of the channel name, so the
+// pattern only matches the channel itself
+func escapePattern(channel string) string {
+	var b strings.Builder
+	for _, r := range channel {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// scriptArgs builds the arguments of the presence scripts. KEYS[1] is the last
+// seen hash, KEYS[2] is the state hash, KEYS[3] is the stream and the
+// rest of KEYS are the given keys. ARGV[1] is the current time in milliseconds,
+// ARGV[2] is the max length of the stream, 0 if the stream is disabled,
+// ARGV[3] is the status channel and the rest of ARGV are the given args
+func (s *Redis) scriptArgs(keys []string, args ...interface{}) []interface{} {
+	res := make([]interface{}, 0, len(keys)+len(args)+7)
+
+	// key count
+	res = append(res, len(keys)+3, s.lastSeenKey, s.stateKey, s.streamKey)
+	for _, key := range keys {
+		res = append(res, key)
+	}
+
+	res = append(res, timeToMs(time.Now()), s.streamMaxLen, s.statusChannel)
+	return append(res, args...)
+}
+
+// idScriptArgs builds the arguments of the scripts that operate on multiple
+// ids, see scriptArgs. KEYS[4] onwards are the prefixed ids, and the raw ids
+// follow the given args in ARGV
+func (s *Redis) idScriptArgs(ids []string, args ...interface{}) []interface{} {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = s.addPrefix(id)
+		args = append(args, id)
+	}
+
+	return s.scriptArgs(keys, args...)
+}
+
+// transitionFunc is the prelude of the presence scripts, see scriptArgs for
+// KEYS and ARGV. The last transition of every id is kept in the state hash as
+// "STATUS SEQ PREVIOUS TIME", so all instances agree on the sequence numbers.
+// transition records a new status of an id and appends it to the stream if the
+// stream is enabled, the same transition is never recorded twice. notify
+// publishes the transitions to the status channel as well, it is used for all
+// but the expirations, they are notified by redis itself. Ids that are created
+// while their offline transition is not recorded yet, e.g. they expired or
+// went offline explicitly, get their offline transition recorded first
+const transitionFunc = `
+local function state(id)
+	local value = redis.call("HGET", KEYS[2], id)
+	if not value then
+		return "OFFLINE", 0
+	end
+
+	local status, seq = string.match(value, "^(%S+) (%d+)")
+	return status, tonumber(seq)
+end
+
+local function transition(id, status)
+	local previous, seq = state(id)
+	if previous == status then
+		return nil
+	end
+
+	seq = seq + 1
+	local record = status .. " " .. seq .. " " .. previous .. " " .. ARGV[1]
+	redis.call("HSET", KEYS[2], id, record)
+
+	if ARGV[2] ~= "0" then
+		redis.call("XADD", KEYS[3], "MAXLEN", "~", ARGV[2], "*",
+			"id", id, "status", status, "previous", previous, "seq", seq, "time", ARGV[1])
+	end
+
+	return record
+end
+
+local function notify(id, status, created)
+	if created and state(id) ~= "OFFLINE" then
+		transition(id, "OFFLINE")
+	end
+
+	local record = transition(id, status)
+	if record then
+		redis.call("PUBLISH", ARGV[3], record .. " " .. id)
+	end
+end
+`
+
+// onlineScript refreshes the expiration time of the given keys and creates the
+// ones that do not exist in one atomic call, see idScriptArgs for KEYS and
+// ARGV. ARGV[4] is the inactive duration in milliseconds and ARGV[5] is the
+// status of the created keys. Replies with 1 for the keys that are created, 0
+// for the refreshed ones, only the created ones are notified
+var onlineScript = gredis.NewScript(-1, transitionFunc+`
+local res = {}
+for i = 4, #KEYS do
+	local id = ARGV[i + 2]
+	if redis.call("PEXPIRE", KEYS[i], ARGV[4]) == 1 then
+		res[i - 3] = 0
+	else
+		redis.call("PSETEX", KEYS[i], ARGV[4], ARGV[5])
+		notify(id, ARGV[5], true)
+		res[i - 3] = 1
+	end
+	redis.call("HSET", KEYS[1], id, ARGV[1])
+end
+return res
+`)
+
+// setStatusScript sets the status of the given keys and resets their
+// expiration time, see idScriptArgs for KEYS and ARGV. ARGV[4] is the inactive
+// duration in milliseconds and ARGV[5] is the status. Keys already holding the
+// status are only refreshed, so they are not notified
+var setStatusScript = gredis.NewScript(-1, transitionFunc+`
+for i = 4, #KEYS do
+	local id = ARGV[i + 2]
+	local current = redis.call("GET", KEYS[i])
+	if current == ARGV[5] then
+		redis.call("PEXPIRE", KEYS[i], ARGV[4])
+	else
+		redis.call("PSETEX", KEYS[i], ARGV[4], ARGV[5])
+		notify(id, ARGV[5], not current)
+	end
+	redis.call("HSET", KEYS[1], id, ARGV[1])
+end
+return #KEYS - 3
+`)
+
+// offlineScript records the Offline transitions of the given ids if their keys
+// do not exist anymore, see idScriptArgs for KEYS and ARGV. ARGV[4] is 1 if the
+// transitions should be published. Replies with the state of every offline id,
+// the ones that are online again are nil
+var offlineScript = gredis.NewScript(-1, transitionFunc+`
+local res = {}
+for i = 4, #KEYS do
+	local id = ARGV[i + 1]
+	res[i - 3] = false
+	if redis.call("EXISTS", KEYS[i]) == 0 then
+		if ARGV[4] == "1" then
+			notify(id, "OFFLINE", false)
+		else
+			transition(id, "OFFLINE")
+		end
+		res[i - 3] = redis.call("HGET", KEYS[2], id)
+	end
+end
+return res
+`)
+
+// onlineDeviceScript refreshes the device of an id and sets the expiration time
+// of the id and its devices to the latest expiration time of its devices, so
+// the devices of the expired ids do not outlive them, see scriptArgs for
+// the common KEYS and ARGV. KEYS[4] is the prefixed id and KEYS[5] is the
+// devices of the id. ARGV[4] is the inactive duration in milliseconds, ARGV[5]
+// is the status of the created key, ARGV[6] is the raw id and ARGV[7] is the
+// device. Replies with 1 if the id is created, 0 otherwise
+var onlineDeviceScript = gredis.NewScript(-1, transitionFunc+`
+local now = tonumber(ARGV[1])
+redis.call("ZADD", KEYS[5], now + tonumber(ARGV[4]), ARGV[7])
+redis.call("ZREMRANGEBYSCORE", KEYS[5], "-inf", now)
+redis.call("HSET", KEYS[1], ARGV[6], ARGV[1])
+
+local last = redis.call("ZRANGE", KEYS[5], -1, -1, "WITHSCORES")
+redis.call("PEXPIREAT", KEYS[5], last[2])
+if redis.call("PEXPIREAT", KEYS[4], last[2]) == 1 then
+	return 0
+end
+
+redis.call("SET", KEYS[4], ARGV[5], "PX", tonumber(last[2]) - now)
+notify(ARGV[6], ARGV[5], true)
+return 1
+`)
+
+// offlineDeviceScript removes the device of an id, and removes the id as well
+// if it has no other online devices, see onlineDeviceScript for KEYS. ARGV[4]
+// is the raw id and ARGV[5] is the device. Replies with 1 if the id is removed,
+// 0 otherwise
+var offlineDeviceScript = gredis.NewScript(-1, transitionFunc+`
+redis.call("ZREM", KEYS[5], ARGV[5])
+redis.call("ZREMRANGEBYSCORE", KEYS[5], "-inf", ARGV[1])
+redis.call("HSET", KEYS[1], ARGV[4], ARGV[1])
+
+local last = redis.call("ZRANGE", KEYS[5], -1, -1, "WITHSCORES")
+if #last == 0 then
+	redis.call("DEL", KEYS[4], KEYS[5])
+	notify(ARGV[4], "OFFLINE", false)
+	return 1
+end
+
+redis.call("PEXPIREAT", KEYS[4], last[2])
+redis.call("PEXPIREAT", KEYS[5], last[2])
+return 0
+`)
+
+// reservedKeys are the names of the keys that are named as "prefix-name:" like
+// the keys of the ids, see validPrefix
+var reservedKeys = []string{"devices", "group", "contacts", "watchers"}
+
+// validPrefix reports whether the keys of the prefix stay in its own
+// namespace. Keys are split from the ids at the first ':', so a prefix
+// containing it would overlap with the namespace of another prefix. A prefix
+// ending with "-" and a reserved key name would have the ids of another
+// prefix's devices, groups or contacts as its own ids, e.g. "presence-group"
+func validPrefix(prefix string) bool {
+	if prefix == "" || strings.Contains(prefix, ":") {
+		return false
+	}
+
+	for _, name := range reservedKeys {
+		if strings.HasSuffix(prefix, "-"+name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// devicesKey returns the key of the sorted set that holds the devices of an id
+// scored by their expiration time. It is kept out of the id namespace, so it
+// is never mistaken for an id
+func (s *Redis) devicesKey(id string) string {
+	return s.prefix + "-devices:" + id
+}
+
+// online runs the online script for the given ids with the given inactive
+// duration and returns whether the ids became online with this call. Script is
+// sent with EVALSHA and falls back to EVAL if redis replies with NOSCRIPT
+func (s *Redis) online(ctx context.Context, ids []string, duration string) ([]bool, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// get one connection from pool
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// close connection
+	defer c.Close()
+
+	script, args := onlineScript, s.idScriptArgs(ids, duration, Online.String())
+	if s.sortedSet {
+		script, args = zsetOnlineScript, s.zsetScriptArgs(nil, ids, duration, Online.String())
+	}
+
+	values, err := gredis.Ints(script.Do(c, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	// scripts either run as a whole or not at all, so the reply count should
+	// always be the same with the request count
+	if len(values) != len(ids) {
+		return nil, fmt.Errorf(
+			"length is not same Ids: %d Replies: %d",
+			len(ids),
+			len(values),
+		)
+	}
+
+	created := make([]bool, len(values))
+	for i, value := range values {
+		created[i] = value == 1
+	}
+
+	return created, nil
+}
+
+// markOffline records the given time as the last seen time of the ids and
+// removes their devices
+func (s *Redis) markOffline(ctx context.Context, ids []string, t time.Time) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// get one connection from pool
+	c, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	// close connection
+	defer c.Close()
+
+	ms := timeToMs(t)
+	lastSeen := make([]interface{}, 0, len(ids)*2+1)
+	lastSeen = append(lastSeen, s.lastSeenKey)
+	devices := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		lastSeen = append(lastSeen, id, ms)
+		devices = append(devices, s.devicesKey(id))
+	}
+
+	// init multi command
+	if err := c.Send("MULTI"); err != nil {
+		return err
+	}
+
+	if err := c.Send("HMSET", lastSeen...); err != nil {
+		return err
+	}
+
+	if err := c.Send("DEL", devices...); err != nil {
+		return err
+	}
+
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// conn gets a connection from the pool, waiting for a free connection at most
+// until the context is done. Commands of the returned connection are bounded
+// by the deadline of the context
+func (s *Redis) conn(ctx context.Context) (contextConn, error) {
+	if err := ctx.Err(); err != nil {
+		return contextConn{}, err
+	}
+
+	c, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return contextConn{}, err
+	}
+
+	return contextConn{Conn: c, ctx: ctx}, nil
+}
+
+// pubSubConn gets a connection from the pool for subscriptions
+func (s *Redis) pubSubConn() *gredis.PubSubConn {
+	return &gredis.PubSubConn{Conn: s.pool.Get()}
+}
+
+// addPrefix returns the key of the given id
+func (s *Redis) addPrefix(id string) string {
+	return s.prefix + ":" + id
+}
+
+// idFromKey returns the id of the given prefixed key, false is returned if the
+// key is not in the namespace of the backend
+func (s *Redis) idFromKey(key string) (string, bool) {
+	prefix := s.addPrefix("")
+	if !strings.HasPrefix(key, prefix) || len(key) == len(prefix) {
+		return "", false
+	}
+
+	return key[len(prefix):], true
+}
+
+// contextConn is a redis connection that bounds its commands with the deadline
+// of the context
+type contextConn struct {
+	gredis.Conn
+	ctx context.Context
+}
+
+// Do sends a command to the server and returns the received reply, it fails
+// if the context is done before the reply is received
+func (c contextConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, ok := c.ctx.Deadline(); !ok {
+		return c.Conn.Do(cmd, args...)
+	}
+
+	return c.DoWithTimeout(0, cmd, args...)
+}
+
+// DoWithTimeout is Do with the given read timeout, the timeout is shortened
+// to the deadline of the context. Zero timeout means no timeout
+func (c contextConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := c.ctx.Deadline(); ok {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+
+		if timeout == 0 || remaining < timeout {
+			timeout = remaining
+		}
+	}
+
+	return gredis.DoWithTimeout(c.Conn, timeout, cmd, args...)
+}
+
+// Receive receives a pipelined reply from the server, it fails if the context
+// is done before the reply is received
+func (c contextConn) Receive() (interface{}, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	deadline, ok := c.ctx.Deadline()
+	if !ok {
+		return c.Conn.Receive()
+	}
+
+	remaining := deadline.Sub(time.Now())
+	if remaining <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+
+	return gredis.ReceiveWithTimeout(c.Conn, remaining)
+}
+
+// timeToMs converts the time to unix milliseconds
+func timeToMs(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// msToTime converts unix milliseconds to time
+func msToTime(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// durationToMs converts the duration to the milliseconds argument of the
+// expire commands
+func durationToMs(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Millisecond), 10)
+}
+
+// validDuration reports whether redis can expire the keys after exactly the
+// given duration, keys are expired in whole milliseconds
+func validDuration(d time.Duration) bool {
+	return d >= time.Millisecond && d%time.Millisecond == 0
+}
+
+// multiExpire if the system tries to update more than one key at a time
+// inorder to leverage rtt, send multi expire
+func (s *Redis) multiExpire(ctx context.Context, ids []string, duration string) ([]int, error) {
+	// get one connection from pool
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	// close connection
 	defer c.Close()
@@ -349,7 +1748,7 @@ func (s *Redis) multiExpire(ids []string, duration string) ([]int, error) {
 
 	// send expire command for all members
 	for _, id := range ids {
-		err := c.Send("EXPIRE", s.redis.AddPrefix(id), duration)
+		err := c.Send("PEXPIRE", s.addPrefix(id), duration)
 		if err != nil {
 			e.Append(id, err)
 		}
@@ -365,7 +1764,7 @@ func (s *Redis) multiExpire(ids []string, duration string) ([]int, error) {
 }
 
 func (s *Redis) mapResult(ids []string, r interface{}, e Error) ([]int, error) {
-	values, err := s.redis.Values(r)
+	values, err := gredis.Values(r, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -382,7 +1781,7 @@ func (s *Redis) mapResult(ids []string, r interface{}, e Error) ([]int, error) {
 			continue
 		}
 
-		res[i], err = s.redis.Int(values[vIndex])
+		res[i], err = gredis.Int(values[vIndex], nil)
 		if err != nil {
 			e.Append(id, err)
 		}
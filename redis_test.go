@@ -1,11 +1,15 @@
 package presence
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"testing"
 	"time"
+
+	gredis "github.com/garyburd/redigo/redis"
 )
 
 var nextID chan string
@@ -22,20 +26,20 @@ func init() {
 	}()
 }
 
-func initPresence() (*Session, error) {
+func initPresence(opts ...RedisOption) (*Session, error) {
 	connStr := os.Getenv("REDIS_URI")
 	if connStr == "" {
 		connStr = "localhost:6379"
 	}
 
-	backend, err := NewRedis(connStr, 10, testTimeoutDuration)
+	backend, err := NewRedis(connStr, 10, testTimeoutDuration, opts...)
 	if err != nil {
 		return nil, err
 	}
 
 	// adjust config for redis instance
-	c := backend.(*Redis).redis.Pool().Get()
-	if _, err := c.Do("CONFIG", "SET", "notify-keyspace-events", "Ex$"); err != nil {
+	c := backend.(*Redis).pool.Get()
+	if _, err := c.Do("CONFIG", "SET", "notify-keyspace-events", "Ex"); err != nil {
 		return nil, err
 	}
 
@@ -47,8 +51,8 @@ func initPresence() (*Session, error) {
 	return ses, nil
 }
 
-func withConn(f func(s *Session)) error {
-	s, err := initPresence()
+func withConn(f func(s *Session), opts ...RedisOption) error {
+	s, err := initPresence(opts...)
 	if err != nil {
 		return err
 	}
@@ -92,6 +96,77 @@ func TestOnlineMultiple(t *testing.T) {
 	}
 }
 
+func TestOnlineCreated(t *testing.T) {
+	err := withConn(func(s *Session) {
+		ids := []string{<-nextID, <-nextID}
+		if err := s.Online(ids[0]); err != nil {
+			t.Fatal(err)
+		}
+
+		backend := s.backend.(*Redis)
+		created, err := backend.online(context.Background(), ids, backend.inactiveDuration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if created[0] {
+			t.Fatalf("%s was already online, should not be created", ids[0])
+		}
+
+		if !created[1] {
+			t.Fatalf("%s was not online, should be created", ids[1])
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnlineEvents(t *testing.T) {
+	err := withConn(func(s *Session) {
+		events := s.ListenStatusChanges()
+
+		// wait for the subscription
+		time.Sleep(time.Millisecond * 100)
+
+		id := <-nextID
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		// refreshes and unrelated keys should not generate any event
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		c := s.backend.(*Redis).pool.Get()
+		defer c.Close()
+		if _, err := c.Do("SET", <-nextID, "value", "EX", 10); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.SetStatus(Busy, id); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, expected := range []Status{Online, Busy} {
+			select {
+			case event := <-events:
+				if event.ID != id || event.Status != expected {
+					t.Fatalf("event should be {%s %s}, but got: %v", id, expected, event)
+				}
+			case <-time.After(testTimeoutDuration):
+				t.Fatalf("timed out waiting for %s event", expected)
+			}
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestOffline(t *testing.T) {
 	err := withConn(func(s *Session) {
 		id := <-nextID
@@ -174,6 +249,38 @@ func TestStatusOffline(t *testing.T) {
 	}
 }
 
+func TestStatusCustom(t *testing.T) {
+	err := withConn(func(s *Session) {
+		id := <-nextID
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.SetStatus(Away, id); err != nil {
+			t.Fatal(err)
+		}
+
+		// probes should not reset the custom status
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		status, err := s.Status(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := status[0]
+		if res.Status != Away {
+			t.Fatalf("%s should be %s, but it is %s", res.ID, Away, res.Status)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestStatusMultiAllOnline(t *testing.T) {
 	err := withConn(func(s *Session) {
 		ids := []string{<-nextID, <-nextID}
@@ -306,6 +413,42 @@ func TestStatusLen(t *testing.T) {
 	}
 }
 
+func TestStatusFailed(t *testing.T) {
+	err := withConn(func(s *Session) {
+		backend := s.backend.(*Redis)
+		id, other := <-nextID, <-nextID
+
+		// GET fails for the keys that do not hold strings
+		c := backend.pool.Get()
+		defer c.Close()
+		if _, err := c.Do("HSET", backend.addPrefix(id), "field", "value"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Online(other); err != nil {
+			t.Fatal(err)
+		}
+
+		status, err := s.Status(id, other)
+		e, ok := err.(Error)
+		if !ok || !e.Has(id) || e.Len() != 1 {
+			t.Fatalf("only %s should fail, but got: %v", id, err)
+		}
+
+		if status[0].ID != id || status[0].Status != Unknown {
+			t.Fatalf("failed lookup should have its id and be %s, but got: %+v", Unknown, status[0])
+		}
+
+		if status[1].ID != other || status[1].Status != Online {
+			t.Fatalf("%s should be %s, but got: %+v", other, Online, status[1])
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestStatusWithTimeout(t *testing.T) {
 	err := withConn(func(s *Session) {
 		id := <-nextID
@@ -333,6 +476,277 @@ func TestStatusWithTimeout(t *testing.T) {
 	}
 }
 
+func TestDevices(t *testing.T) {
+	err := withConn(func(s *Session) {
+		id := <-nextID
+		if err := s.OnlineDevice(id, "phone"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.OnlineDevice(id, "laptop"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.OfflineDevice(id, "phone"); err != nil {
+			t.Fatal(err)
+		}
+
+		status, err := s.Status(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status[0].Status != Online {
+			t.Fatalf("%s should be %s while it has an online device, but it is %s", id, Online, status[0].Status)
+		}
+
+		if err := s.OfflineDevice(id, "laptop"); err != nil {
+			t.Fatal(err)
+		}
+
+		status, err = s.Status(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status[0].Status != Offline {
+			t.Fatalf("%s should be %s without online devices, but it is %s", id, Offline, status[0].Status)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLastSeen(t *testing.T) {
+	err := withConn(func(s *Session) {
+		seenID := <-nextID
+		unseenID := <-nextID
+
+		// redis stores the times in milliseconds
+		before := time.Now().Truncate(time.Millisecond)
+		if err := s.Online(seenID); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Offline(seenID); err != nil {
+			t.Fatal(err)
+		}
+
+		lastSeen, err := s.LastSeen(seenID, unseenID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if lastSeen[0].Before(before) {
+			t.Fatalf("%s should be seen after %s, but it is seen at %s", seenID, before, lastSeen[0])
+		}
+
+		if !lastSeen[1].IsZero() {
+			t.Fatalf("%s should not be seen, but it is seen at %s", unseenID, lastSeen[1])
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	err := withConn(func(s *Session) {
+		onlineID, offlineID := <-nextID, <-nextID
+
+		before := time.Now().Truncate(time.Millisecond)
+		if err := s.Online(onlineID); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := s.LookupMap(onlineID, offlineID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		online := res[onlineID]
+		if online.Err != nil || online.Status != Online {
+			t.Fatalf("%s should be online, but got: %v", onlineID, online)
+		}
+
+		if online.TTL <= 0 || online.TTL > time.Second {
+			t.Fatalf("ttl of %s should be in (0, 1s], but got: %s", onlineID, online.TTL)
+		}
+
+		if online.LastSeen.Before(before) {
+			t.Fatalf("%s should be seen after %s, but it is seen at %s", onlineID, before, online.LastSeen)
+		}
+
+		offline := res[offlineID]
+		if offline != (Result{ID: offlineID, Status: Offline}) {
+			t.Fatalf("%s should be offline and never seen, but got: %v", offlineID, offline)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	err := withConn(func(s *Session) {
+		onlineID, offlineID := <-nextID, <-nextID
+		if err := s.Online(onlineID); err != nil {
+			t.Fatal(err)
+		}
+
+		ttl, err := s.TTL(onlineID, offlineID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ttl[0] <= 0 || ttl[0] > testTimeoutDuration {
+			t.Fatalf("ttl of %s should be in (0, %s], but got: %s", onlineID, testTimeoutDuration, ttl[0])
+		}
+
+		if ttl[1] != 0 {
+			t.Fatalf("ttl of %s should be 0, but got: %s", offlineID, ttl[1])
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnlineTTL(t *testing.T) {
+	err := withConn(func(s *Session) {
+		id := <-nextID
+		if err := s.OnlineTTL(testTimeoutDuration*10, id); err != nil {
+			t.Fatal(err)
+		}
+
+		ttl, err := s.TTL(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ttl[0] <= testTimeoutDuration {
+			t.Fatalf("ttl of %s should be more than %s, but got: %s", id, testTimeoutDuration, ttl[0])
+		}
+
+		// sub-second durations are kept in milliseconds
+		shortID := <-nextID
+		if err := s.OnlineTTL(time.Millisecond*200, shortID); err != nil {
+			t.Fatal(err)
+		}
+
+		if ttl, err = s.TTL(shortID); err != nil || ttl[0] <= 0 || ttl[0] > time.Millisecond*200 {
+			t.Fatalf("ttl of %s should be in (0, 200ms], but got: %v %v", shortID, ttl, err)
+		}
+
+		time.Sleep(time.Millisecond * 400)
+
+		status, err := s.Status(shortID)
+		if err != nil || status[0].Status != Offline {
+			t.Fatalf("%s should be offline, but got: %v %v", shortID, status, err)
+		}
+
+		if err := s.OnlineTTL(time.Microsecond*1500, id); err != ErrInvalidDuration {
+			t.Fatalf("err should be %s, but got: %v", ErrInvalidDuration, err)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListOnline(t *testing.T) {
+	err := withConn(func(s *Session) {
+		ids := make([]string, 25)
+		for i := range ids {
+			ids[i] = <-nextID
+		}
+
+		if err := s.Online(ids...); err != nil {
+			t.Fatal(err)
+		}
+
+		count, err := s.Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != len(ids) {
+			t.Fatalf("count should be %d, but got: %d", len(ids), count)
+		}
+
+		listed := make(map[string]struct{})
+		for cursor := ""; ; {
+			page, next, err := s.ListOnline(cursor, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, id := range page {
+				listed[id] = struct{}{}
+			}
+
+			if cursor = next; cursor == "" {
+				break
+			}
+		}
+
+		if len(listed) != len(ids) {
+			t.Fatalf("%d ids should be listed, but got: %d", len(ids), len(listed))
+		}
+
+		if _, _, err := s.ListOnline("", 0); err != ErrInvalidLimit {
+			t.Fatalf("err should be %s, but got: %v", ErrInvalidLimit, err)
+		}
+	}, WithPrefix("list"+<-nextID))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidDuration(t *testing.T) {
+	for _, d := range []time.Duration{0, -time.Second, time.Microsecond * 999, time.Microsecond * 1500} {
+		if validDuration(d) {
+			t.Fatalf("%s should not be valid", d)
+		}
+
+		if _, err := NewRedis("localhost:6379", 10, d); err != ErrInvalidDuration {
+			t.Fatalf("err should be %s for %s, but got: %v", ErrInvalidDuration, d, err)
+		}
+	}
+
+	for _, d := range []time.Duration{time.Millisecond, time.Millisecond * 1900, time.Minute} {
+		if !validDuration(d) {
+			t.Fatalf("%s should be valid", d)
+		}
+	}
+
+	if ms := durationToMs(time.Millisecond * 1900); ms != "1900" {
+		t.Fatalf("1.9s should be 1900ms, but got: %s", ms)
+	}
+}
+
+func TestLookupResult(t *testing.T) {
+	if r := lookupResult("id", []byte(away), int64(1500)); r != (Result{ID: "id", Status: Away, TTL: time.Millisecond * 1500}) {
+		t.Fatalf("id should be away for 1.5s, but got: %v", r)
+	}
+
+	// missing keys
+	if r := lookupResult("id", nil, int64(-2)); r != (Result{ID: "id", Status: Offline}) {
+		t.Fatalf("id should be offline, but got: %v", r)
+	}
+
+	if r := lookupResult("id", []byte(away), "ttl"); r.ID != "id" || r.Err == nil {
+		t.Fatalf("lookup of id should fail, but got: %v", r)
+	}
+}
+
 func TestSubscriptions(t *testing.T) {
 	err := withConn(func(s *Session) {
 
@@ -379,3 +793,156 @@ func TestSubscriptions(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestContext(t *testing.T) {
+	err := withConn(func(s *Session) {
+		ctx, cancel := context.WithCancel(context.Background())
+		events := s.ListenStatusChangesContext(ctx)
+
+		if _, err := s.StatusContext(ctx, <-nextID); err != nil {
+			t.Fatal(err)
+		}
+
+		cancel()
+
+		if _, err := s.StatusContext(ctx, <-nextID); err != context.Canceled {
+			t.Fatalf("err should be %s, but got: %v", context.Canceled, err)
+		}
+
+		select {
+		case _, ok := <-events:
+			if ok {
+				t.Fatal("events channel should be closed when the context is done")
+			}
+		case <-time.After(testTimeoutDuration):
+			t.Fatal("events channel should be closed when the context is done")
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stalledConn is a connection whose server never replies
+type stalledConn struct {
+	gredis.Conn
+}
+
+func (stalledConn) Receive() (interface{}, error) {
+	select {}
+}
+
+func (stalledConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	time.Sleep(timeout)
+	return nil, errors.New("i/o timeout")
+}
+
+func (c stalledConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return c.ReceiveWithTimeout(timeout)
+}
+
+func TestContextConnReceive(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	c := contextConn{Conn: stalledConn{}, ctx: ctx}
+
+	start := time.Now()
+	if _, err := c.Receive(); err == nil {
+		t.Fatal("receive should fail after the deadline")
+	}
+
+	if elapsed := time.Since(start); elapsed > testTimeoutDuration {
+		t.Fatalf("receive should return by the deadline, but took: %s", elapsed)
+	}
+
+	if _, err := c.Receive(); err != context.DeadlineExceeded {
+		t.Fatalf("err should be %s, but got: %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestSubscriptionReconnect(t *testing.T) {
+	err := withConn(func(s *Session) {
+		events := s.ListenStatusChanges()
+
+		// drop the pubsub connections of the server
+		c := s.backend.(*Redis).pool.Get()
+		if _, err := c.Do("CLIENT", "KILL", "TYPE", "pubsub"); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+
+		timeout := time.After(maxReconnectDelay)
+	wait:
+		for {
+			select {
+			case err := <-s.Error():
+				if err == ErrReconnected {
+					break wait
+				}
+			case <-timeout:
+				t.Fatal("subscription should be reconnected")
+			}
+		}
+
+		id := <-nextID
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case event := <-events:
+			if event.ID != id || event.Status != Online {
+				t.Fatalf("event should be {%s %s}, but got: %v", id, Online, event)
+			}
+		case <-time.After(testTimeoutDuration):
+			t.Fatal("events should be received after reconnecting")
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubscribeMultiple(t *testing.T) {
+	err := withConn(func(s *Session) {
+		subs := make([]*Subscription, 3)
+		for i := range subs {
+			sub, err := s.Subscribe(WithBuffer(10))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			subs[i] = sub
+		}
+
+		// wait for the subscription
+		time.Sleep(time.Millisecond * 100)
+
+		if err := subs[0].Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		id := <-nextID
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, sub := range subs[1:] {
+			select {
+			case event := <-sub.Events():
+				if event.ID != id || event.Status != Online {
+					t.Fatalf("event should be {%s %s}, but got: %v", id, Online, event)
+				}
+			case <-time.After(testTimeoutDuration):
+				t.Fatal("every subscription should receive the event")
+			}
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
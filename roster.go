@@ -0,0 +1,277 @@
+package presence
+
+import (
+	"context"
+	"sync"
+
+	gredis "github.com/garyburd/redigo/redis"
+)
+
+// Notification tells the online watchers of an id that its status changed
+type Notification struct {
+	// Event is the status change of the id
+	Event Event
+
+	// Watchers are the online ids that have the id in their contacts
+	Watchers []string
+}
+
+// Roster fans out the status changes of the ids to their online watchers, so
+// every change is sent only to the ids that should be notified of it instead
+// of every participant
+type Roster struct {
+	backend Backend
+
+	// sub holds the status changes of the backend
+	sub *Subscription
+
+	// notifications are sent until done is closed
+	notifications chan Notification
+	done          chan struct{}
+	once          sync.Once
+
+	errChan chan error
+}
+
+// AddContacts adds the given contacts to the roster of the id, the id becomes
+// a watcher of every contact
+func (s *Session) AddContacts(id string, contacts ...string) error {
+	return s.backend.AddContacts(id, contacts...)
+}
+
+// AddContactsContext is the context aware version of AddContacts
+func (s *Session) AddContactsContext(ctx context.Context, id string, contacts ...string) error {
+	return s.backend.AddContactsContext(ctx, id, contacts...)
+}
+
+// RemoveContacts removes the given contacts from the roster of the id
+func (s *Session) RemoveContacts(id string, contacts ...string) error {
+	return s.backend.RemoveContacts(id, contacts...)
+}
+
+// RemoveContactsContext is the context aware version of RemoveContacts
+func (s *Session) RemoveContactsContext(ctx context.Context, id string, contacts ...string) error {
+	return s.backend.RemoveContactsContext(ctx, id, contacts...)
+}
+
+// Contacts returns the contacts in the roster of the id
+func (s *Session) Contacts(id string) ([]string, error) {
+	return s.backend.Contacts(id)
+}
+
+// ContactsContext is the context aware version of Contacts
+func (s *Session) ContactsContext(ctx context.Context, id string) ([]string, error) {
+	return s.backend.ContactsContext(ctx, id)
+}
+
+// OnlineWatchers returns the ids that have the given id in their contacts and
+// are not offline, they are the ones to notify of the changes of the id
+func (s *Session) OnlineWatchers(id string) ([]string, error) {
+	return s.OnlineWatchersContext(context.Background(), id)
+}
+
+// OnlineWatchersContext is the context aware version of OnlineWatchers
+func (s *Session) OnlineWatchersContext(ctx context.Context, id string) ([]string, error) {
+	return onlineWatchers(ctx, s.backend, id)
+}
+
+// SubscribeRoster creates a Roster that sends a Notification for every status
+// change that has online watchers. Options are applied to the subscription of
+// the status changes, see Policy for the rosters that are not read fast enough
+func (s *Session) SubscribeRoster(opts ...SubscribeOption) (*Roster, error) {
+	return s.SubscribeRosterContext(context.Background(), opts...)
+}
+
+// SubscribeRosterContext is the context aware version of SubscribeRoster, the
+// roster is closed when the context is done
+func (s *Session) SubscribeRosterContext(ctx context.Context, opts ...SubscribeOption) (*Roster, error) {
+	sub, err := s.backend.SubscribeContext(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Roster{
+		backend:       s.backend,
+		sub:           sub,
+		notifications: make(chan Notification),
+		done:          make(chan struct{}),
+		errChan:       make(chan error, 1),
+	}
+
+	go r.run()
+	return r, nil
+}
+
+// Notifications returns the channel that the notifications are sent to. The
+// channel is closed when the roster or the session is closed
+func (r *Roster) Notifications() chan Notification {
+	return r.notifications
+}
+
+// Error returns the errors of the watcher lookups, changes whose watchers can
+// not be looked up are skipped
+func (r *Roster) Error() chan error {
+	return r.errChan
+}
+
+// Close stops the roster and closes its channel
+func (r *Roster) Close() error {
+	r.once.Do(func() {
+		close(r.done)
+	})
+
+	return r.sub.Close()
+}
+
+// run looks up the online watchers of every status change until the
+// subscription is closed
+func (r *Roster) run() {
+	defer close(r.notifications)
+
+	ctx := context.Background()
+	for e := range r.sub.Events() {
+		watchers, err := onlineWatchers(ctx, r.backend, e.ID)
+		if err != nil {
+			r.reportError(err)
+			continue
+		}
+
+		if len(watchers) == 0 {
+			continue
+		}
+
+		select {
+		case r.notifications <- Notification{Event: e, Watchers: watchers}:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// reportError sends the error to the error channel without blocking
+func (r *Roster) reportError(err error) {
+	select {
+	case r.errChan <- err:
+	default:
+	}
+}
+
+// onlineWatchers returns the watchers of the id that are not offline
+func onlineWatchers(ctx context.Context, backend Backend, id string) ([]string, error) {
+	watchers, err := backend.WatchersContext(ctx, id)
+	if err != nil || len(watchers) == 0 {
+		return nil, err
+	}
+
+	status, err := backend.StatusContext(ctx, watchers...)
+	if err != nil {
+		return nil, err
+	}
+
+	online := watchers[:0]
+	for _, st := range status {
+		if st.Status != Offline {
+			online = append(online, st.ID)
+		}
+	}
+
+	return online, nil
+}
+
+// AddContacts adds the contacts to the roster set of the id and the id to the
+// watchers sets of the contacts in one transaction
+func (s *Redis) AddContacts(id string, contacts ...string) error {
+	return s.AddContactsContext(context.Background(), id, contacts...)
+}
+
+// AddContactsContext is the context aware version of AddContacts
+func (s *Redis) AddContactsContext(ctx context.Context, id string, contacts ...string) error {
+	return s.changeContacts(ctx, "SADD", id, contacts)
+}
+
+// RemoveContacts removes the contacts from the roster set of the id and the id
+// from the watchers sets of the contacts in one transaction
+func (s *Redis) RemoveContacts(id string, contacts ...string) error {
+	return s.RemoveContactsContext(context.Background(), id, contacts...)
+}
+
+// RemoveContactsContext is the context aware version of RemoveContacts
+func (s *Redis) RemoveContactsContext(ctx context.Context, id string, contacts ...string) error {
+	return s.changeContacts(ctx, "SREM", id, contacts)
+}
+
+// changeContacts runs the given set command for the roster of the id and the
+// watchers of the contacts
+func (s *Redis) changeContacts(ctx context.Context, cmd, id string, contacts []string) error {
+	if len(contacts) == 0 {
+		return nil
+	}
+
+	// get one connection from pool
+	c, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	// close connection
+	defer c.Close()
+
+	args := make([]interface{}, 0, len(contacts)+1)
+	args = append(args, s.contactsKey(id))
+	for _, contact := range contacts {
+		args = append(args, contact)
+	}
+
+	// init multi command
+	c.Send("MULTI")
+	c.Send(cmd, args...)
+	for _, contact := range contacts {
+		c.Send(cmd, s.watchersKey(contact), id)
+	}
+
+	_, err = c.Do("EXEC")
+	return err
+}
+
+// Contacts returns the roster set of the id
+func (s *Redis) Contacts(id string) ([]string, error) {
+	return s.ContactsContext(context.Background(), id)
+}
+
+// ContactsContext is the context aware version of Contacts
+func (s *Redis) ContactsContext(ctx context.Context, id string) ([]string, error) {
+	return s.members(ctx, s.contactsKey(id))
+}
+
+// Watchers returns the ids that have the given id in their rosters
+func (s *Redis) Watchers(id string) ([]string, error) {
+	return s.WatchersContext(context.Background(), id)
+}
+
+// WatchersContext is the context aware version of Watchers
+func (s *Redis) WatchersContext(ctx context.Context, id string) ([]string, error) {
+	return s.members(ctx, s.watchersKey(id))
+}
+
+// members returns the members of the given set
+func (s *Redis) members(ctx context.Context, key string) ([]string, error) {
+	// get one connection from pool
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// close connection
+	defer c.Close()
+
+	return gredis.Strings(c.Do("SMEMBERS", key))
+}
+
+// contactsKey returns the key of the roster set of the id
+func (s *Redis) contactsKey(id string) string {
+	return s.prefix + "-contacts:" + id
+}
+
+// watchersKey returns the key of the set of the ids that have the id in their
+// rosters
+func (s *Redis) watchersKey(id string) string {
+	return s.prefix + "-watchers:" + id
+}
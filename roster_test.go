@@ -0,0 +1,221 @@
+package presence
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// expectNotification fails if the next notification of the roster is not for
+// the given change with the given watchers
+func expectNotification(t *testing.T, r *Roster, expected Event, watchers ...string) {
+	select {
+	case n, ok := <-r.Notifications():
+		if !ok {
+			t.Fatalf("channel is closed while waiting for %v", expected)
+		}
+
+		if n.Event.ID != expected.ID || n.Event.Status != expected.Status {
+			t.Fatalf("event should be %v, but got: %v", expected, n.Event)
+		}
+
+		if fmt.Sprint(n.Watchers) != fmt.Sprint(watchers) {
+			t.Fatalf("watchers of %v should be %v, but got: %v", expected, watchers, n.Watchers)
+		}
+	case <-time.After(testMemoryTimeoutDuration * 5):
+		t.Fatalf("timed out waiting for %v", expected)
+	}
+}
+
+func TestMemoryContacts(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		if err := s.AddContacts("alice", "bob", "carol"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.AddContacts("dave", "bob"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.RemoveContacts("alice", "carol"); err != nil {
+			t.Fatal(err)
+		}
+
+		contacts, err := s.Contacts("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fmt.Sprint(contacts) != "[bob]" {
+			t.Fatalf("contacts of alice should be [bob], but got: %v", contacts)
+		}
+
+		if err := s.Online("alice"); err != nil {
+			t.Fatal(err)
+		}
+
+		// dave is offline, so only alice is notified
+		watchers, err := s.OnlineWatchers("bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fmt.Sprint(watchers) != "[alice]" {
+			t.Fatalf("online watchers of bob should be [alice], but got: %v", watchers)
+		}
+
+		if watchers, err = s.OnlineWatchers("carol"); err != nil || len(watchers) != 0 {
+			t.Fatalf("carol should not have watchers, but got: %v %v", watchers, err)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryRoster(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		r, err := s.SubscribeRoster(WithBuffer(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.AddContacts("alice", "bob"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.AddContacts("bob", "alice"); err != nil {
+			t.Fatal(err)
+		}
+
+		// nobody is online to be notified of alice
+		if err := s.Online("alice"); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(testMemoryTimeoutDuration / 2)
+
+		if err := s.Online("bob"); err != nil {
+			t.Fatal(err)
+		}
+
+		expectNotification(t, r, Event{ID: "bob", Status: Online}, "alice")
+
+		// alice expires first and bob is notified, then bob expires without
+		// an online watcher
+		expectNotification(t, r, Event{ID: "alice", Status: Offline}, "bob")
+
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := <-r.Notifications(); ok {
+			t.Fatal("channel of the closed roster should be closed")
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryRosterOffline(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		r, err := s.SubscribeRoster(WithBuffer(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		if err := s.AddContacts("alice", "bob"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Online("bob"); err != nil {
+			t.Fatal(err)
+		}
+
+		// bob has no online watchers yet
+		time.Sleep(testMemoryTimeoutDuration / 2)
+
+		if err := s.Online("alice"); err != nil {
+			t.Fatal(err)
+		}
+
+		// logging out is notified before the expiration of bob
+		if err := s.Offline("bob"); err != nil {
+			t.Fatal(err)
+		}
+
+		expectNotification(t, r, Event{ID: "bob", Status: Offline}, "alice")
+
+		// removing the last device is a log out as well
+		if err := s.OnlineDevice("bob", "phone"); err != nil {
+			t.Fatal(err)
+		}
+
+		expectNotification(t, r, Event{ID: "bob", Status: Online}, "alice")
+
+		if err := s.OfflineDevice("bob", "phone"); err != nil {
+			t.Fatal(err)
+		}
+
+		expectNotification(t, r, Event{ID: "bob", Status: Offline}, "alice")
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoster(t *testing.T) {
+	err := withConn(func(s *Session) {
+		watcher, contact := <-nextID, <-nextID
+
+		r, err := s.SubscribeRoster(WithBuffer(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		if err := s.AddContacts(watcher, contact); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Online(watcher); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.SetStatus(Away, contact); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case n := <-r.Notifications():
+			if n.Event.ID != contact || n.Event.Status != Away || fmt.Sprint(n.Watchers) != fmt.Sprint([]string{watcher}) {
+				t.Fatalf("%s should be notified that %s is away, but got: %v", watcher, contact, n)
+			}
+		case <-time.After(testTimeoutDuration):
+			t.Fatal("timed out waiting for the notification")
+		}
+
+		// logging out is notified as well
+		if err := s.Offline(contact); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case n := <-r.Notifications():
+			if n.Event.ID != contact || n.Event.Status != Offline || fmt.Sprint(n.Watchers) != fmt.Sprint([]string{watcher}) {
+				t.Fatalf("%s should be notified that %s is offline, but got: %v", watcher, contact, n)
+			}
+		case <-time.After(testTimeoutDuration):
+			t.Fatal("timed out waiting for the notification")
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
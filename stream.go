@@ -0,0 +1,354 @@
+package presence
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	gredis "github.com/garyburd/redigo/redis"
+)
+
+var (
+	// ErrStreamDisabled for stating the stream is not enabled on the backend
+	ErrStreamDisabled = errors.New("stream is not enabled")
+)
+
+const (
+	// streamBlockDuration is the max time a stream read waits for new entries
+	streamBlockDuration = time.Second
+
+	// streamReadCount is the max entry count of a stream read
+	streamReadCount = 100
+
+	// streamRetryDuration is the wait time after a failed stream operation
+	streamRetryDuration = time.Second
+
+	// streamReplyMargin is the extra wait time for the reply of a blocking
+	// read, so the client does not give up at the same time with the server
+	streamReplyMargin = time.Second
+)
+
+// ListenStream reads the status transitions from the stream as the given
+// consumer of the consumer group. Instances sharing the same group share the
+// load, every entry is delivered to only one of them. Entries are acknowledged
+// after they are received from the channel, and unacknowledged ones of the
+// consumer are redelivered first when it starts listening again.
+//
+// Expirations are appended to the stream by the listening instances through
+// keyspace notifications, so at least one instance should be listening for
+// offline transitions of the expired ids
+func (s *Redis) ListenStream(group, consumer string) (chan Event, error) {
+	return s.ListenStreamContext(context.Background(), group, consumer)
+}
+
+// ListenStreamContext is the context aware version of ListenStream. Reading
+// stops and the channel is closed when the context is done or the connection
+// is closed
+func (s *Redis) ListenStreamContext(ctx context.Context, group, consumer string) (chan Event, error) {
+	if s.streamMaxLen == 0 {
+		return nil, ErrStreamDisabled
+	}
+
+	if err := s.createGroup(ctx, group); err != nil {
+		return nil, err
+	}
+
+	// sweeper records the offline transitions of the sorted set storage
+	if !s.sortedSet {
+		s.forwardExpirations()
+	}
+
+	events := make(chan Event)
+	go s.readStream(ctx, group, consumer, events)
+	return events, nil
+}
+
+// createGroup creates the consumer group if it does not exist. New groups
+// start consuming from the entries added after their creation
+func (s *Redis) createGroup(ctx context.Context, group string) error {
+	// get one connection from pool
+	c, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	// close connection
+	defer c.Close()
+
+	_, err = c.Do("XGROUP", "CREATE", s.streamKey, group, "$", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+
+	return nil
+}
+
+// readStream delivers the stream entries to the events channel until the
+// context is done or the connection is closed. Pending entries of the consumer
+// are read before the new ones
+func (s *Redis) readStream(ctx context.Context, group, consumer string, events chan Event) {
+	defer close(events)
+
+	// "0" reads the pending entries of the consumer, ">" reads the new ones
+	start := "0"
+	for !s.isClosed() && ctx.Err() == nil {
+		entries, err := s.readGroup(ctx, group, consumer, start)
+		if err != nil {
+			if s.isClosed() || ctx.Err() != nil {
+				return
+			}
+
+			s.reportError(err)
+
+			// entries may be delivered to the consumer while the reply is
+			// lost, read the pending ones again
+			start = "0"
+
+			select {
+			case <-time.After(streamRetryDuration):
+			case <-ctx.Done():
+			case <-s.done:
+			}
+
+			continue
+		}
+
+		// all pending entries are consumed, continue with the new ones
+		if start == "0" && len(entries) == 0 {
+			start = ">"
+			continue
+		}
+
+		for _, entry := range entries {
+			if entry.event.ID != "" {
+				select {
+				case events <- entry.event:
+				case <-ctx.Done():
+					return
+				case <-s.done:
+					return
+				}
+			}
+
+			if err := s.ack(ctx, group, entry.id); err != nil {
+				s.reportError(err)
+			}
+		}
+	}
+}
+
+// streamEntry holds a stream entry id and its event
+type streamEntry struct {
+	id    string
+	event Event
+}
+
+// readGroup reads the entries of the consumer starting from the given id
+func (s *Redis) readGroup(ctx context.Context, group, consumer, start string) ([]streamEntry, error) {
+	// get one connection from pool
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// close connection
+	defer c.Close()
+
+	// reads block on the server, wait for the reply longer than that
+	timeout := streamBlockDuration + streamReplyMargin + s.readTimeout
+	r, err := c.DoWithTimeout(
+		timeout, "XREADGROUP", "GROUP", group, consumer,
+		"COUNT", streamReadCount,
+		"BLOCK", int(streamBlockDuration/time.Millisecond),
+		"STREAMS", s.streamKey, start,
+	)
+	if err == gredis.ErrNil || (err == nil && r == nil) {
+		// block duration is elapsed without any new entries
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	streams, err := gredis.Values(r, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []streamEntry
+	for _, stream := range streams {
+		// every stream reply is a pair of stream name and its entries
+		pair, err := gredis.Values(stream, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(pair) != 2 {
+			return nil, errors.New("invalid stream reply")
+		}
+
+		items, err := gredis.Values(pair[1], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range items {
+			entry, err := parseStreamEntry(item)
+			if err != nil {
+				return nil, err
+			}
+
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// parseStreamEntry converts a stream entry reply to streamEntry, entries with
+// invalid fields are returned with an empty event, so they are acknowledged
+// without delivering
+func parseStreamEntry(item interface{}) (streamEntry, error) {
+	entry := streamEntry{}
+
+	// every entry is a pair of entry id and its fields
+	pair, err := gredis.Values(item, nil)
+	if err != nil {
+		return entry, err
+	}
+
+	if len(pair) != 2 {
+		return entry, errors.New("invalid stream entry")
+	}
+
+	entry.id, err = gredis.String(pair[0], nil)
+	if err != nil {
+		return entry, err
+	}
+
+	// fields of the deleted entries are nil
+	if pair[1] == nil {
+		return entry, nil
+	}
+
+	fields, err := gredis.StringMap(pair[1], nil)
+	if err != nil {
+		return entry, err
+	}
+
+	status, err := parseStatus(fields["status"])
+	if err != nil {
+		return entry, nil
+	}
+
+	entry.event = Event{ID: fields["id"], Status: status}
+
+	// entries appended by the older versions do not have the details of the
+	// transition
+	if previous, err := parseStatus(fields["previous"]); err == nil {
+		entry.event.Previous = previous
+	}
+
+	if seq, err := strconv.ParseInt(fields["seq"], 10, 64); err == nil {
+		entry.event.Seq = seq
+	}
+
+	if ms, err := strconv.ParseInt(fields["time"], 10, 64); err == nil {
+		entry.event.Time = msToTime(ms)
+	}
+
+	return entry, nil
+}
+
+// ack acknowledges the stream entry for the consumer group
+func (s *Redis) ack(ctx context.Context, group, id string) error {
+	// get one connection from pool
+	c, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	// close connection
+	defer c.Close()
+
+	_, err = c.Do("XACK", s.streamKey, group, id)
+	return err
+}
+
+// forwardExpirations starts appending the expired ids to the stream, if it is
+// not already started
+func (s *Redis) forwardExpirations() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.forwarder != nil {
+		return
+	}
+
+	s.forwarder = s.pubSubConn()
+	s.forwarder.PSubscribe(s.becameOfflinePattern)
+
+	go s.listenExpirations()
+}
+
+// listenExpirations appends the expired ids to the stream until the backend is
+// closed, and re-establishes the subscription if it drops
+func (s *Redis) listenExpirations() {
+	for {
+		s.mu.Lock()
+		psc := s.forwarder
+		s.mu.Unlock()
+
+		switch n := psc.ReceiveWithTimeout(0).(type) {
+		case gredis.PMessage:
+			id, ok := s.idFromKey(string(n.Data))
+			if !ok {
+				continue
+			}
+
+			if _, err := s.recordOffline(context.Background(), []string{id}, false); err != nil {
+				s.reportError(err)
+			}
+		case error:
+			if s.isClosed() {
+				return
+			}
+
+			s.reportError(n)
+
+			psc, ok := s.resubscribe(context.Background(), s.becameOfflinePattern)
+			if !ok {
+				return
+			}
+
+			s.mu.Lock()
+			if s.closed {
+				s.mu.Unlock()
+				psc.Close()
+				return
+			}
+
+			// dropped connection still holds its slot in the pool
+			s.forwarder.Close()
+			s.forwarder = psc
+			s.mu.Unlock()
+		}
+	}
+}
+
+// isClosed returns true if the backend is closed
+func (s *Redis) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// reportError sends the error to the error channel without blocking, if the
+// channel is full the error is dropped
+func (s *Redis) reportError(err error) {
+	select {
+	case s.errChan <- err:
+	default:
+	}
+}
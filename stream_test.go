@@ -0,0 +1,103 @@
+package presence
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseStreamEntry(t *testing.T) {
+	id := <-nextID
+	item := []interface{}{
+		[]byte("1-0"),
+		[]interface{}{[]byte("id"), []byte(id), []byte("status"), []byte(busy)},
+	}
+
+	entry, err := parseStreamEntry(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.id != "1-0" {
+		t.Fatalf("entry id should be 1-0, but got: %s", entry.id)
+	}
+
+	if entry.event.ID != id || entry.event.Status != Busy {
+		t.Fatalf("event should be {%s %s}, but got: %v", id, Busy, entry.event)
+	}
+
+	// details of the transition
+	item[1] = []interface{}{
+		[]byte("id"), []byte(id), []byte("status"), []byte(away),
+		[]byte("previous"), []byte(busy), []byte("seq"), []byte("4"), []byte("time"), []byte("1500000000000"),
+	}
+
+	entry, err = parseStreamEntry(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Event{ID: id, Status: Away, Previous: Busy, Time: msToTime(1500000000000), Seq: 4}
+	if entry.event != expected {
+		t.Fatalf("event should be %v, but got: %v", expected, entry.event)
+	}
+
+	// deleted entries have nil fields
+	entry, err = parseStreamEntry([]interface{}{[]byte("2-0"), nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.event.ID != "" {
+		t.Fatalf("deleted entry should not have an event, but got: %v", entry.event)
+	}
+}
+
+func TestStreamDisabled(t *testing.T) {
+	err := withConn(func(s *Session) {
+		if _, err := s.backend.(*Redis).ListenStream("group", "consumer"); err != ErrStreamDisabled {
+			t.Fatalf("err should be %s, but got: %v", ErrStreamDisabled, err)
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	err := withConn(func(s *Session) {
+		events, err := s.backend.(*Redis).ListenStream(<-nextID, "consumer")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id := <-nextID
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		// refreshes should not be appended to the stream
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.SetStatus(Away, id); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, expected := range []Status{Online, Away, Offline} {
+			select {
+			case event := <-events:
+				if event.ID != id || event.Status != expected {
+					t.Fatalf("event should be {%s %s}, but got: %v", id, expected, event)
+				}
+			case <-time.After(testTimeoutDuration * 3):
+				t.Fatalf("timed out waiting for %s event", expected)
+			}
+		}
+	}, WithStream(1000))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,203 @@
+package presence
+
+import "sync"
+
+// watchBufferSize is the buffer size of the event channels of the watchers
+const watchBufferSize = 64
+
+// Watcher receives the status changes of a set of ids
+type Watcher struct {
+	hub *watchHub
+
+	// ids that are watched, guarded by the mutex of the hub
+	ids map[string]struct{}
+
+	// sub holds the events channel of the watcher
+	sub *Subscription
+}
+
+// Watch returns a Watcher that receives the status changes of the given ids
+// only. The status changes of the backend are received with a single
+// subscription for all watchers of the session, so a watcher that is not read
+// fast enough only keeps the latest status of every id, see Coalesce, instead
+// of blocking the others
+func (s *Session) Watch(ids ...string) (*Watcher, error) {
+	return s.watch.add(s.backend, ids)
+}
+
+// Events returns the channel that the status changes of the watched ids are
+// sent to. The channel is closed when the watcher or the session is closed
+func (w *Watcher) Events() chan Event {
+	return w.sub.Events()
+}
+
+// Watch adds the given ids to the watched ones
+func (w *Watcher) Watch(ids ...string) error {
+	return w.hub.watch(w, ids)
+}
+
+// Unwatch removes the given ids from the watched ones
+func (w *Watcher) Unwatch(ids ...string) {
+	w.hub.unwatch(w, ids)
+}
+
+// Close stops the watcher and closes its channel
+func (w *Watcher) Close() error {
+	w.hub.remove(w)
+	return w.sub.Close()
+}
+
+// watchHub indexes the watchers by the ids and dispatches the events of the
+// backend to the watchers of their ids
+type watchHub struct {
+	// watchers of every watched id, and all watchers
+	watchers map[string]map[*Watcher]struct{}
+	all      map[*Watcher]struct{}
+
+	// started is true when the backend is subscribed, stopped is true when
+	// the subscription is closed
+	started bool
+	stopped bool
+
+	mu sync.Mutex
+}
+
+// newWatchHub creates an empty hub
+func newWatchHub() *watchHub {
+	return &watchHub{
+		watchers: make(map[string]map[*Watcher]struct{}),
+		all:      make(map[*Watcher]struct{}),
+	}
+}
+
+// add creates a watcher for the ids, and starts listening the backend for the
+// first watcher
+func (h *watchHub) add(backend Backend, ids []string) (*Watcher, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.stopped {
+		return nil, ErrClosed
+	}
+
+	if !h.started {
+		sub, err := backend.Subscribe()
+		if err != nil {
+			return nil, err
+		}
+
+		h.started = true
+		go h.run(sub.Events())
+	}
+
+	w := &Watcher{
+		hub: h,
+		ids: make(map[string]struct{}),
+		sub: newSubscription([]SubscribeOption{
+			WithBuffer(watchBufferSize),
+			WithPolicy(Coalesce),
+		}),
+	}
+
+	h.all[w] = struct{}{}
+	h.index(w, ids)
+
+	return w, nil
+}
+
+// watch adds the ids of the watcher to the index
+func (h *watchHub) watch(w *Watcher, ids []string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.stopped || w.ids == nil {
+		return ErrClosed
+	}
+
+	h.index(w, ids)
+	return nil
+}
+
+// index adds the ids of the watcher to the index, mu should be held
+func (h *watchHub) index(w *Watcher, ids []string) {
+	for _, id := range ids {
+		w.ids[id] = struct{}{}
+
+		watchers, ok := h.watchers[id]
+		if !ok {
+			watchers = make(map[*Watcher]struct{})
+			h.watchers[id] = watchers
+		}
+
+		watchers[w] = struct{}{}
+	}
+}
+
+// unwatch removes the ids of the watcher from the index
+func (h *watchHub) unwatch(w *Watcher, ids []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.unindex(w, ids)
+}
+
+// unindex removes the ids of the watcher from the index, mu should be held
+func (h *watchHub) unindex(w *Watcher, ids []string) {
+	for _, id := range ids {
+		if _, ok := w.ids[id]; !ok {
+			continue
+		}
+
+		delete(w.ids, id)
+
+		watchers := h.watchers[id]
+		delete(watchers, w)
+		if len(watchers) == 0 {
+			delete(h.watchers, id)
+		}
+	}
+}
+
+// remove removes all ids of the watcher from the index
+func (h *watchHub) remove(w *Watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ids := make([]string, 0, len(w.ids))
+	for id := range w.ids {
+		ids = append(ids, id)
+	}
+
+	h.unindex(w, ids)
+	w.ids = nil
+	delete(h.all, w)
+}
+
+// run dispatches the events until the subscription of the backend is closed,
+// then closes the watchers
+func (h *watchHub) run(events chan Event) {
+	var watchers []*Watcher
+	for e := range events {
+		h.mu.Lock()
+		watchers = watchers[:0]
+		for w := range h.watchers[e.ID] {
+			watchers = append(watchers, w)
+		}
+		h.mu.Unlock()
+
+		for _, w := range watchers {
+			w.sub.send(e)
+		}
+	}
+
+	h.mu.Lock()
+	h.stopped = true
+	closed := h.all
+	h.all = make(map[*Watcher]struct{})
+	h.watchers = make(map[string]map[*Watcher]struct{})
+	h.mu.Unlock()
+
+	for w := range closed {
+		w.sub.close()
+	}
+}
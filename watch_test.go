@@ -0,0 +1,199 @@
+package presence
+
+import (
+	"testing"
+	"time"
+)
+
+// expectEvent fails if the id and the status of the next event of the channel
+// are not the expected ones
+func expectEvent(t *testing.T, events chan Event, expected Event) {
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatalf("channel is closed while waiting for %v", expected)
+		}
+
+		if e.ID != expected.ID || e.Status != expected.Status {
+			t.Fatalf("event should be %v, but got: %v", expected, e)
+		}
+	case <-time.After(testMemoryTimeoutDuration * 5):
+		t.Fatalf("timed out waiting for %v", expected)
+	}
+}
+
+// expectNoEvent fails if an event is received from the channel
+func expectNoEvent(t *testing.T, events chan Event) {
+	select {
+	case e := <-events:
+		t.Fatalf("there should not be any event, but got: %v", e)
+	case <-time.After(testMemoryTimeoutDuration / 2):
+	}
+}
+
+func TestMemoryWatch(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		watched, other := <-nextID, <-nextID
+
+		w, err := s.Watch(watched)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Online(other, watched); err != nil {
+			t.Fatal(err)
+		}
+
+		expectEvent(t, w.Events(), Event{ID: watched, Status: Online})
+		expectEvent(t, w.Events(), Event{ID: watched, Status: Offline})
+		expectNoEvent(t, w.Events())
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryWatchMultiple(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		id1, id2 := <-nextID, <-nextID
+
+		w1, err := s.Watch(id1, id2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w2, err := s.Watch(id1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Online(id1); err != nil {
+			t.Fatal(err)
+		}
+
+		expectEvent(t, w1.Events(), Event{ID: id1, Status: Online})
+		expectEvent(t, w2.Events(), Event{ID: id1, Status: Online})
+
+		if err := s.Online(id2); err != nil {
+			t.Fatal(err)
+		}
+
+		expectEvent(t, w1.Events(), Event{ID: id2, Status: Online})
+		expectNoEvent(t, w2.Events())
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryWatchSlow(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		id := <-nextID
+
+		// slow is never read, it should not block the other watchers
+		slow, err := s.Watch(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer slow.Close()
+
+		w, err := s.Watch(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < watchBufferSize*2; i++ {
+			status := Away
+			if i%2 == 1 {
+				status = Busy
+			}
+
+			if err := s.SetStatus(status, id); err != nil {
+				t.Fatal(err)
+			}
+
+			expectEvent(t, w.Events(), Event{ID: id, Status: status})
+		}
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryWatchUnwatch(t *testing.T) {
+	err := withMemory(func(s *Session) {
+		id1, id2 := <-nextID, <-nextID
+
+		w, err := s.Watch(id1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := w.Watch(id2); err != nil {
+			t.Fatal(err)
+		}
+
+		w.Unwatch(id1)
+
+		if err := s.Online(id1, id2); err != nil {
+			t.Fatal(err)
+		}
+
+		expectEvent(t, w.Events(), Event{ID: id2, Status: Online})
+		expectNoEvent(t, w.Events())
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryWatchClose(t *testing.T) {
+	backend, err := NewMemory(testMemoryTimeoutDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w1, err := s.Watch(<-nextID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w2, err := s.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w1.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := <-w1.Events(); ok {
+		t.Fatal("channel of the closed watcher should be closed")
+	}
+
+	if err := w1.Watch(<-nextID); err != ErrClosed {
+		t.Fatalf("err should be %s, but got: %v", ErrClosed, err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case _, ok := <-w2.Events():
+		if ok {
+			t.Fatal("channel of the watcher should be closed with the session")
+		}
+	case <-time.After(testMemoryTimeoutDuration):
+		t.Fatal("timed out waiting for the channel to be closed")
+	}
+}
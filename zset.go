@@ -0,0 +1,335 @@
+package presence
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	gredis "github.com/garyburd/redigo/redis"
+)
+
+// zsetScriptArgs builds the arguments of the sorted set scripts, see
+// scriptArgs. KEYS[4] is the sorted set of the online ids, KEYS[5] is the hash
+// of their statuses and the rest of KEYS are the given keys. Raw ids follow
+// the given args in ARGV
+func (s *Redis) zsetScriptArgs(keys, ids []string, args ...interface{}) []interface{} {
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	return s.scriptArgs(append([]string{s.onlineKey, s.statusesKey}, keys...), args...)
+}
+
+// zsetFunc is the prelude of the sorted set scripts, see zsetScriptArgs for
+// KEYS and ARGV. alive reports whether the id is online. Ids whose scores are
+// passed but are not swept yet get their Offline transitions published first,
+// so their next transitions are never notified without the Offline ones
+const zsetFunc = transitionFunc + `
+local function alive(id, now)
+	local score = redis.call("ZSCORE", KEYS[4], id)
+	if not score then
+		return false
+	end
+
+	if tonumber(score) > now then
+		return true
+	end
+
+	redis.call("ZREM", KEYS[4], id)
+	redis.call("HDEL", KEYS[5], id)
+	notify(id, "OFFLINE", false)
+	return false
+end
+`
+
+// zsetOnlineScript is the onlineScript of the sorted set storage, see
+// zsetScriptArgs for KEYS and ARGV. ARGV[4] is the inactive duration in
+// milliseconds, ARGV[5] is the status of the created ids and ARGV[6] onwards
+// are the ids. Ids whose scores are passed are created again after their
+// Offline transitions are published, even if they are not swept yet. Replies
+// with 1 for the created ids, 0 for the refreshed ones
+var zsetOnlineScript = gredis.NewScript(-1, zsetFunc+`
+local now = tonumber(ARGV[1])
+local deadline = now + tonumber(ARGV[4])
+local res = {}
+for i = 6, #ARGV do
+	local id = ARGV[i]
+	local online = alive(id, now)
+	redis.call("ZADD", KEYS[4], deadline, id)
+	if online then
+		res[i - 5] = 0
+	else
+		redis.call("HSET", KEYS[5], id, ARGV[5])
+		notify(id, ARGV[5], true)
+		res[i - 5] = 1
+	end
+	redis.call("HSET", KEYS[1], id, ARGV[1])
+end
+return res
+`)
+
+// zsetSetStatusScript is the setStatusScript of the sorted set storage, see
+// zsetOnlineScript for KEYS and ARGV. Ids already holding the status are only
+// refreshed, so they are not notified
+var zsetSetStatusScript = gredis.NewScript(-1, zsetFunc+`
+local now = tonumber(ARGV[1])
+local deadline = now + tonumber(ARGV[4])
+for i = 6, #ARGV do
+	local id = ARGV[i]
+	local current = false
+	if alive(id, now) then
+		current = redis.call("HGET", KEYS[5], id)
+	end
+
+	redis.call("ZADD", KEYS[4], deadline, id)
+	if current ~= ARGV[5] then
+		redis.call("HSET", KEYS[5], id, ARGV[5])
+		notify(id, ARGV[5], not current)
+	end
+	redis.call("HSET", KEYS[1], id, ARGV[1])
+end
+return #ARGV - 5
+`)
+
+// zsetOfflineScript removes the given ids from the sorted set and notifies
+// their Offline transitions, see zsetScriptArgs for KEYS and ARGV. ARGV[4]
+// onwards are the ids
+var zsetOfflineScript = gredis.NewScript(-1, transitionFunc+`
+for i = 4, #ARGV do
+	redis.call("ZREM", KEYS[4], ARGV[i])
+	redis.call("HDEL", KEYS[5], ARGV[i])
+	notify(ARGV[i], "OFFLINE", false)
+end
+return #ARGV - 3
+`)
+
+// zsetOnlineDeviceScript is the onlineDeviceScript of the sorted set storage,
+// see zsetScriptArgs for the common KEYS and ARGV. KEYS[6] is the devices of
+// the id. ARGV[4] is the inactive duration in milliseconds, ARGV[5] is the
+// status of the created id, ARGV[6] is the device and ARGV[7] is the raw id.
+// Score of the id and the expiration time of its devices are set to the latest
+// expiration time of its devices. Replies with 1 if the id is created, 0
+// otherwise
+var zsetOnlineDeviceScript = gredis.NewScript(-1, zsetFunc+`
+local now = tonumber(ARGV[1])
+redis.call("ZADD", KEYS[6], now + tonumber(ARGV[4]), ARGV[6])
+redis.call("ZREMRANGEBYSCORE", KEYS[6], "-inf", now)
+redis.call("HSET", KEYS[1], ARGV[7], ARGV[1])
+
+local online = alive(ARGV[7], now)
+local last = redis.call("ZRANGE", KEYS[6], -1, -1, "WITHSCORES")
+redis.call("PEXPIREAT", KEYS[6], last[2])
+redis.call("ZADD", KEYS[4], last[2], ARGV[7])
+if online then
+	return 0
+end
+
+redis.call("HSET", KEYS[5], ARGV[7], ARGV[5])
+notify(ARGV[7], ARGV[5], true)
+return 1
+`)
+
+// zsetOfflineDeviceScript is the offlineDeviceScript of the sorted set
+// storage, see zsetOnlineDeviceScript for KEYS. ARGV[4] is the device and
+// ARGV[5] is the raw id. Replies with 1 if the id is removed, 0 otherwise
+var zsetOfflineDeviceScript = gredis.NewScript(-1, transitionFunc+`
+redis.call("ZREM", KEYS[6], ARGV[4])
+redis.call("ZREMRANGEBYSCORE", KEYS[6], "-inf", ARGV[1])
+redis.call("HSET", KEYS[1], ARGV[5], ARGV[1])
+
+local last = redis.call("ZRANGE", KEYS[6], -1, -1, "WITHSCORES")
+if #last == 0 then
+	redis.call("DEL", KEYS[6])
+	redis.call("ZREM", KEYS[4], ARGV[5])
+	redis.call("HDEL", KEYS[5], ARGV[5])
+	notify(ARGV[5], "OFFLINE", false)
+	return 1
+end
+
+redis.call("ZADD", KEYS[4], "XX", last[2], ARGV[5])
+redis.call("PEXPIREAT", KEYS[6], last[2])
+return 0
+`)
+
+// sweepScript removes the expired ids from the sorted set, records their
+// Offline transitions and publishes them to the status channel, see
+// zsetScriptArgs for KEYS and ARGV. ARGV[4] is the max number of the ids to
+// remove. Every id is removed by exactly one sweep, so its transition is
+// published once even if several instances are sweeping. Replies with the
+// number of the removed ids
+var sweepScript = gredis.NewScript(-1, transitionFunc+`
+local ids = redis.call("ZRANGEBYSCORE", KEYS[4], "-inf", ARGV[1], "LIMIT", 0, ARGV[4])
+for _, id in ipairs(ids) do
+	redis.call("ZREM", KEYS[4], id)
+	redis.call("HDEL", KEYS[5], id)
+	notify(id, "OFFLINE", false)
+end
+return #ids
+`)
+
+// zsetOffline removes the given ids from the sorted set storage
+func (s *Redis) zsetOffline(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// get one connection from pool
+	c, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	// close connection
+	defer c.Close()
+
+	_, err = zsetOfflineScript.Do(c, s.zsetScriptArgs(nil, ids)...)
+	return err
+}
+
+// sweep removes the expired ids from the sorted set in every sweep interval
+// until the backend is closed
+func (s *Redis) sweep() {
+	ticker := time.NewTicker(s.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		if err := s.sweepExpired(context.Background()); err != nil && !s.isClosed() {
+			s.reportError(err)
+		}
+	}
+}
+
+// sweepExpired runs the sweep script until there are no expired ids left
+func (s *Redis) sweepExpired(ctx context.Context) error {
+	// get one connection from pool
+	c, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	// close connection
+	defer c.Close()
+
+	for {
+		n, err := gredis.Int(sweepScript.Do(c, s.zsetScriptArgs(nil, nil, sweepBatchSize)...))
+		if err != nil {
+			return err
+		}
+
+		if n < sweepBatchSize {
+			return nil
+		}
+	}
+}
+
+// zsetStatus returns the statuses of the ids from the sorted set storage, see
+// Status for the failed lookups
+func (s *Redis) zsetStatus(ctx context.Context, ids []string) ([]Event, error) {
+	results, err := s.LookupContext(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Error{}
+	res := make([]Event, len(results))
+	for i, r := range results {
+		if r.Err != nil {
+			e.Append(r.ID, r.Err)
+			res[i] = Event{ID: r.ID}
+			continue
+		}
+
+		res[i] = Event{ID: r.ID, Status: r.Status}
+	}
+
+	if e.Len() > 0 {
+		return res, e
+	}
+
+	return res, nil
+}
+
+// zsetTTL returns the remaining times of the ids from the sorted set storage,
+// see TTL for the failed lookups
+func (s *Redis) zsetTTL(ctx context.Context, ids []string) ([]time.Duration, error) {
+	results, err := s.LookupContext(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Error{}
+	res := make([]time.Duration, len(results))
+	for i, r := range results {
+		if r.Err != nil {
+			e.Append(r.ID, r.Err)
+			continue
+		}
+
+		res[i] = r.TTL
+	}
+
+	if e.Len() > 0 {
+		return res, e
+	}
+
+	return res, nil
+}
+
+// zsetResult creates the result of an id from the replies of HGET and ZSCORE.
+// Ids whose scores are not after now are offline, even if they are not swept
+// yet
+func zsetResult(id string, value, score interface{}, now int64) Result {
+	deadline, err := gredis.Int64(score, nil)
+	if err == gredis.ErrNil || (err == nil && deadline <= now) {
+		return Result{ID: id, Status: Offline}
+	}
+
+	if err != nil {
+		return Result{ID: id, Err: err}
+	}
+
+	status, err := redisResToStatus(value)
+	if err != nil {
+		return Result{ID: id, Err: err}
+	}
+
+	res := Result{ID: id, Status: status}
+	if status != Offline {
+		res.TTL = time.Duration(deadline-now) * time.Millisecond
+	}
+
+	return res
+}
+
+// zsetScan runs one ZSCAN iteration over the sorted set and returns the ids
+// that are not expired with the next cursor, "0" if the iteration is done
+func (s *Redis) zsetScan(c gredis.Conn, cursor string, count int) ([]string, string, error) {
+	values, err := gredis.Values(c.Do("ZSCAN", s.onlineKey, cursor, "COUNT", count))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var pairs []string
+	if _, err := gredis.Scan(values, &cursor, &pairs); err != nil {
+		return nil, "", err
+	}
+
+	now := timeToMs(time.Now())
+	ids := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		deadline, err := strconv.ParseInt(pairs[i+1], 10, 64)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if deadline > now {
+			ids = append(ids, pairs[i])
+		}
+	}
+
+	return ids, cursor, nil
+}
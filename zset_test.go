@@ -0,0 +1,150 @@
+package presence
+
+import (
+	"testing"
+	"time"
+)
+
+func TestZSetResult(t *testing.T) {
+	now := int64(10000)
+
+	res := zsetResult("id", []byte("AWAY"), []byte("12500"), now)
+	if res.Err != nil || res.Status != Away || res.TTL != time.Millisecond*2500 {
+		t.Fatalf("id should be away for 2.5s, but got: %+v", res)
+	}
+
+	// expired ids are offline before they are swept
+	if res = zsetResult("id", []byte("AWAY"), []byte("10000"), now); res.Status != Offline || res.TTL != 0 {
+		t.Fatalf("expired id should be offline, but got: %+v", res)
+	}
+
+	if res = zsetResult("id", nil, nil, now); res.Err != nil || res.Status != Offline {
+		t.Fatalf("missing id should be offline, but got: %+v", res)
+	}
+
+	if res = zsetResult("id", nil, []byte("score"), now); res.Err == nil {
+		t.Fatalf("invalid score should fail, but got: %+v", res)
+	}
+}
+
+func TestSortedSetInvalidInterval(t *testing.T) {
+	// options are validated before connecting
+	if _, err := NewRedis("localhost:0", 10, time.Second, WithSortedSet(0)); err == nil {
+		t.Fatal("sweep interval should be positive")
+	}
+}
+
+func TestSortedSet(t *testing.T) {
+	opts := []RedisOption{WithPrefix(<-nextID), WithSortedSet(time.Millisecond * 10)}
+	err := withConn(func(s *Session) {
+		sub, err := s.Subscribe(WithBuffer(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+
+		id, other := <-nextID, <-nextID
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		expectRedisEvent(t, sub.Events(), Event{ID: id, Status: Online})
+
+		if err := s.SetStatus(Away, id); err != nil {
+			t.Fatal(err)
+		}
+
+		expectRedisEvent(t, sub.Events(), Event{ID: id, Status: Away})
+
+		if err := s.OnlineTTL(testTimeoutDuration*10, other); err != nil {
+			t.Fatal(err)
+		}
+
+		expectRedisEvent(t, sub.Events(), Event{ID: other, Status: Online})
+
+		count, err := s.Count()
+		if err != nil || count != 2 {
+			t.Fatalf("count should be 2, but got: %d %v", count, err)
+		}
+
+		ttl, err := s.TTL(id, other)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ttl[0] <= 0 || ttl[0] > testTimeoutDuration || ttl[1] <= testTimeoutDuration {
+			t.Fatalf("ttls should be in (0, %s] and over it, but got: %v", testTimeoutDuration, ttl)
+		}
+
+		// id is swept after the inactive duration without keyspace
+		// notifications
+		expectRedisEvent(t, sub.Events(), Event{ID: id, Status: Offline})
+
+		status, err := s.Status(id, other)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status[0].Status != Offline || status[1].Status != Online {
+			t.Fatalf("%s should be offline and %s online, but got: %v", id, other, status)
+		}
+
+		ids, cursor, err := s.ListOnline("", 10)
+		if err != nil || cursor != "" || len(ids) != 1 || ids[0] != other {
+			t.Fatalf("only %s should be listed, but got: %v %q %v", other, ids, cursor, err)
+		}
+
+		if err := s.Offline(other); err != nil {
+			t.Fatal(err)
+		}
+
+		expectRedisEvent(t, sub.Events(), Event{ID: other, Status: Offline})
+
+		if count, err = s.Count(); err != nil || count != 0 {
+			t.Fatalf("count should be 0, but got: %d %v", count, err)
+		}
+	}, opts...)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSortedSetProbeAfterDeadline(t *testing.T) {
+	// sweeper does not run during the test
+	opts := []RedisOption{WithPrefix(<-nextID), WithSortedSet(time.Hour)}
+	err := withConn(func(s *Session) {
+		sub, err := s.Subscribe(WithBuffer(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+
+		id := <-nextID
+		if err := s.OnlineTTL(time.Millisecond*50, id); err != nil {
+			t.Fatal(err)
+		}
+
+		expectRedisEvent(t, sub.Events(), Event{ID: id, Status: Online})
+
+		time.Sleep(time.Millisecond * 100)
+
+		status, err := s.Status(id)
+		if err != nil || status[0].Status != Offline {
+			t.Fatalf("%s should be offline before it is swept, but got: %v %v", id, status, err)
+		}
+
+		// id probes again before it is swept, its Offline transition is
+		// published before the Online one
+		if err := s.Online(id); err != nil {
+			t.Fatal(err)
+		}
+
+		expectRedisEvent(t, sub.Events(), Event{ID: id, Status: Offline})
+		expectRedisEvent(t, sub.Events(), Event{ID: id, Status: Online})
+	}, opts...)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}